@@ -0,0 +1,496 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+// Package client submits the outputs of a process run, and the notification describing
+// the run, to a transmeta server.
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy says when outputs are sent to the file server, or when they are verified by it.
+type Policy int
+
+const (
+	Never Policy = iota
+	WhenRequired
+	Always
+)
+
+// Default settings of a Client returned by New.
+var (
+	DefaultHashes     = []string{"sha256", "sha1"}
+	DefaultTransports = []string{"upload", "http", "rsync", "scp"}
+	DefaultRetry      = common.Backoff{Attempts: 5, Initial: 2 * time.Second, Max: 2 * time.Minute}
+)
+
+// Client submits outputs and notifications to a transmeta server. Its fields may be
+// changed after the Client is returned by New and before it is first used. A Client
+// holds a connection to the server open between exchanges until it is closed.
+type Client struct {
+	Host string
+	Port int
+	TLS  *tls.Config // Client certificate and verification of the server.
+
+	Hashes  []string          // Hash algorithms to offer the server in order of preference.
+	Digests []string          // Additional hash algorithms to record for outputs.
+	Chunk   int64             // Chunk size for resending damaged parts of outputs; 0 to disable.
+	Jobs    int               // Number of files to hash concurrently.
+	Cache   *common.HashCache // Cache of file hashes; nil for none.
+
+	SendPolicy   Policy // When to send outputs to the file server.
+	VerifyPolicy Policy // When to have the server verify outputs.
+
+	Transfers  int            // Number of files to send concurrently.
+	Transports []string       // Transfer backends in order of preference.
+	Encodings  []string       // Transfer encodings to offer for compressible files.
+	Retry      common.Backoff // Retrying of failed copies.
+
+	PendingDir string      // Directory of the queue of unfinished submissions; empty for no queue.
+	ReceiptDir string      // Directory in which receipts of accepted submissions are saved; empty to not save them.
+	Log        *log.Logger // Destination of messages describing progress; nil to discard them.
+	Progress   *Progress   // Reporter of transfer progress; nil for none.
+
+	once   sync.Once
+	err    error
+	config *websocket.Config
+	slots  chan struct{} // limits the number of concurrent transfers
+	sess   *session
+}
+
+// New returns a Client of the server at host and port, authenticating with the
+// certificate in tlsConfig.
+func New(host string, port int, tlsConfig *tls.Config) *Client {
+	return &Client{
+		Host:         host,
+		Port:         port,
+		TLS:          tlsConfig,
+		Hashes:       DefaultHashes,
+		Chunk:        common.DefaultChunkSize,
+		Jobs:         4,
+		SendPolicy:   WhenRequired,
+		VerifyPolicy: WhenRequired,
+		Transfers:    2,
+		Transports:   DefaultTransports,
+		Encodings:    common.Encodings,
+		Retry:        DefaultRetry,
+	}
+}
+
+// init prepares c for its first use.
+func (c *Client) init() error {
+	c.once.Do(func() {
+		if len(c.Hashes) == 0 {
+			c.err = errors.New("No hash algorithm to offer.")
+			return
+		}
+		for _, h := range append(append([]string(nil), c.Hashes...), c.Digests...) {
+			if _, err := common.NewHash(h); err != nil {
+				c.err = err
+				return
+			}
+		}
+		if c.SendPolicy < Never || c.SendPolicy > Always || c.VerifyPolicy < Never || c.VerifyPolicy > Always {
+			c.err = errors.New(fmt.Sprintf("Illegal policy: send %d, verify %d.", c.SendPolicy, c.VerifyPolicy))
+			return
+		}
+		origin := "http://localhost/"
+		if c.config, c.err = websocket.NewConfig(origin, origin); c.err != nil {
+			return
+		}
+		c.config.TlsConfig = c.TLS
+		n := c.Transfers
+		if n < 1 {
+			n = 1
+		}
+		c.slots = make(chan struct{}, n)
+		c.sess = newSession()
+	})
+	return c.err
+}
+
+// Close closes the connection held open to the server. The Client may be used again,
+// in which case a new connection is made.
+func (c *Client) Close() {
+	if c.init() == nil {
+		c.sess.close()
+	}
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.Log != nil {
+		c.Log.Printf(format, v...)
+	}
+}
+
+func (c *Client) logln(v ...interface{}) {
+	if c.Log != nil {
+		c.Log.Println(v...)
+	}
+}
+
+// Submission describes a process run whose outputs are submitted to the server.
+type Submission struct {
+	Name     string
+	Project  string
+	Category string
+	Comment  string
+	Tool     string
+	Version  string
+	Slop     string // Key=Val pairs of additional data separated by spaces.
+	Runtime  time.Duration
+
+	// ID identifies the submission to the server, which accepts a notification sent
+	// more than once with the same ID only once. If empty, one is chosen by Submit.
+	ID string `json:",omitempty"`
+}
+
+// Failure describes a copy of a file that failed permanently or after all retries.
+type Failure struct {
+	Path   string
+	Resume bool // The server holds part of the file and a later upload will resume.
+	Err    error
+}
+
+func (f Failure) String() string {
+	if f.Resume {
+		return fmt.Sprintf("%s: %v (resubmit to resume the upload)", f.Path, f.Err)
+	}
+	return fmt.Sprintf("%s: %v", f.Path, f.Err)
+}
+
+// Result is the outcome of a submission.
+type Result struct {
+	Submission
+	Links   *common.Links
+	Failed  []Failure // Copies that failed; the notification is withheld until they succeed.
+	Pending []string  // Hashes of the outputs pending verification by the server.
+	Queued  string    // Pending queue entry holding the submission, if it was queued.
+
+	Accepted *common.Acceptance // The server's acceptance of the notification, if it sent one.
+	Receipt  string             // File holding the receipt of the acceptance, if it was saved.
+}
+
+// Submit hashes the files described by args, sends the outputs to the file server as
+// required by c.SendPolicy and notifies the server of the submission s. If the server
+// cannot be reached, a copy fails or the notification cannot be sent, the submission is
+// queued for a later Resume.
+func (c *Client) Submit(ctx context.Context, s Submission, args []string) (r *Result, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	var (
+		ws   *websocket.Conn
+		done func(error)
+		alg  = c.Hashes[0]
+		encs []string
+		cerr error
+	)
+	// The files are hashed with the preferred algorithm if the server cannot be reached
+	// so that the submission can be queued.
+	if c.SendPolicy != Never {
+		ws, done, alg, encs, cerr = c.negotiate(ctx, c.Hashes)
+		if cerr != nil {
+			done, alg = nil, c.Hashes[0]
+			if ctx.Err() != nil {
+				return nil, cerr
+			}
+		}
+	}
+	l, err := c.hash(ctx, alg, args)
+	if err != nil {
+		if done != nil {
+			done(err)
+		}
+		return
+	}
+	e := c.newEntry(s, l)
+	if cerr != nil {
+		return c.hold(e, cerr)
+	}
+	failed, err := c.deliver(ctx, c.SendPolicy, ws, done, l, encs)
+	if err != nil {
+		if ctx.Err() != nil {
+			return e.result(failed, nil), err
+		}
+		return c.hold(e, err)
+	}
+	return c.complete(ctx, e, failed)
+}
+
+// Notify sends the notification of s with the files of l, returning the server's
+// acceptance of the notification, if it sends one, and the hashes of outputs that are
+// pending verification by the server.
+func (c *Client) Notify(ctx context.Context, s Submission, l *common.Links) (a *common.Acceptance, pending []string, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	n := common.NewNotification(s.Name, s.Project, s.Category, s.Comment, s.Tool, s.Version, s.Slop, s.Runtime, l)
+	n.Submission = s.ID
+	ws, done, err := c.exchange(ctx, "notify")
+	if err != nil {
+		return
+	}
+	defer func() { done(err) }()
+	if err = websocket.JSON.Send(ws, n); err != nil {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	for {
+		m, err := c.receive(ws)
+		if err != nil {
+			return nil, nil, ctxErr(ctx, err)
+		}
+		switch m.Kind {
+		case common.KindOK:
+			c.logln("Thankyou.")
+			return a, pending, nil
+		case common.KindData:
+			a = &common.Acceptance{}
+			if err = m.Decode(a); err != nil {
+				return nil, nil, err
+			}
+			if a.Retry {
+				c.logf("Submission %s was already accepted at %v; not logged again.", a.Submission, a.Time.Format(time.RFC3339))
+			}
+		case common.KindStatus:
+			var states []common.Status
+			if err = m.Decode(&states); err != nil {
+				return nil, nil, err
+			}
+			for _, s := range states {
+				c.logStatus(s)
+				if !s.Final() {
+					pending = append(pending, s.Hash)
+				}
+			}
+		default:
+			c.logln(m)
+		}
+	}
+}
+
+// Status queries the server for the verification state of the outputs with the given
+// hashes. If wait is true, Status waits for pending verifications to complete, logging
+// each as it does.
+func (c *Client) Status(ctx context.Context, hashes []string, wait bool) (states []common.Status, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	ws, done, err := c.exchange(ctx, "status")
+	if err != nil {
+		return
+	}
+	defer func() { done(err) }()
+	if err = websocket.JSON.Send(ws, common.StatusQuery{Hashes: hashes, Wait: wait}); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if err = c.receiveData(ws, common.KindStatus, &states); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if wait {
+		for _, s := range states {
+			if s.Final() {
+				c.logStatus(s)
+			}
+		}
+	}
+	for {
+		m, err := c.receive(ws)
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		if m.Kind == common.KindOK {
+			break
+		}
+		var changed []common.Status
+		if m.Kind != common.KindStatus {
+			return nil, errors.New(fmt.Sprintf("Bad message: expected status message, got %s: %q.", m.Kind, m.Message))
+		} else if err = m.Decode(&changed); err != nil {
+			return nil, err
+		}
+		for _, s := range changed {
+			c.logStatus(s)
+			for i := range states {
+				if states[i].Hash == s.Hash {
+					states[i] = s
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// Query returns a page of the notifications stored by the server that match q. The next
+// page is returned by querying again with q.After set to the Next of the result.
+func (c *Client) Query(ctx context.Context, q common.Query) (r *common.QueryResult, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	ws, done, err := c.exchange(ctx, "query")
+	if err != nil {
+		return
+	}
+	defer func() { done(err) }()
+	if err = websocket.JSON.Send(ws, q); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	r = &common.QueryResult{}
+	if err = c.receiveData(ws, common.KindData, r); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if err = c.receiveOK(ws); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	return
+}
+
+func (c *Client) logStatus(s common.Status) {
+	if len(s.Messages) == 0 {
+		c.logf("%q (%s) verification %s.", s.Name, s.Hash, s.State)
+	}
+	for _, m := range s.Messages {
+		c.logln(m)
+	}
+}
+
+// ctxErr returns the error of ctx if it is done, since err is then the result of
+// closing the connection, and err otherwise.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// dial connects to the named endpoint of the server. The connection is made with a copy
+// of the websocket configuration so that connections may be made concurrently.
+func (c *Client) dial(ctx context.Context, endpoint string) (ws *websocket.Conn, err error) {
+	config := *c.config
+	config.Location, err = url.ParseRequestURI(fmt.Sprintf("wss://%s:%d/%s", c.Host, c.Port, endpoint))
+	if err != nil {
+		return
+	}
+
+	// DialConfig cannot be cancelled, so a connection made after ctx is done is closed.
+	type dialed struct {
+		ws  *websocket.Conn
+		err error
+	}
+	ch := make(chan dialed, 1)
+	go func() {
+		ws, err := websocket.DialConfig(&config)
+		ch <- dialed{ws, err}
+	}()
+	select {
+	case d := <-ch:
+		return d.ws, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-ch; d.err == nil {
+				d.ws.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// hello opens an exchange by sending the protocol versions and features of the client,
+// returning the version and features agreed by the server.
+func hello(ws *websocket.Conn) (h common.Hello, err error) {
+	if err = websocket.JSON.Send(ws, common.NewHello()); err != nil {
+		return
+	}
+	// Servers before protocol version 2 reply with a bare string or Hello.
+	var m string
+	if err = websocket.Message.Receive(ws, &m); err != nil {
+		return
+	} else if strings.HasPrefix(m, "Error") {
+		return h, common.Permanent(errors.New(m))
+	}
+	var msg common.Message
+	if err = json.Unmarshal([]byte(m), &msg); err != nil || msg.Kind == "" {
+		return h, common.Permanent(errors.New(fmt.Sprintf("Server speaks an older protocol than this client: %q.", m)))
+	}
+	if err = msg.Err(); err != nil {
+		return h, common.Permanent(err)
+	}
+	if err = msg.Decode(&h); err != nil {
+		return
+	}
+	return h, h.Accept()
+}
+
+// receive returns the next message sent by the server, logging and skipping warnings.
+// An error message is returned as a *common.Error, marked permanent if resending cannot
+// correct it.
+func (c *Client) receive(ws *websocket.Conn) (m common.Message, err error) {
+	for {
+		if err = websocket.JSON.Receive(ws, &m); err != nil {
+			return
+		}
+		if m.Kind != common.KindWarning {
+			break
+		}
+		c.logln(m)
+	}
+	if err = m.Err(); err != nil {
+		switch common.ErrorCode(err) {
+		case common.CodeBadMessage, common.CodeIncompatible, common.CodeUnsupported, common.CodeAuth, common.CodeTooLarge:
+			err = common.Permanent(err)
+		}
+	}
+	return
+}
+
+// receiveData receives the next message, which must be of the given kind, and decodes
+// its data into v.
+func (c *Client) receiveData(ws *websocket.Conn, kind string, v interface{}) (err error) {
+	m, err := c.receive(ws)
+	if err != nil {
+		return
+	}
+	if m.Kind != kind {
+		return errors.New(fmt.Sprintf("Bad message: expected %s message, got %s: %q.", kind, m.Kind, m.Message))
+	}
+	return m.Decode(v)
+}
+
+// receiveOK receives the message that ends a successful exchange.
+func (c *Client) receiveOK(ws *websocket.Conn) (err error) {
+	m, err := c.receive(ws)
+	if err != nil {
+		return
+	}
+	if m.Kind != common.KindOK {
+		return errors.New(fmt.Sprintf("Bad message: expected ok message, got %s: %q.", m.Kind, m.Message))
+	}
+	return
+}
@@ -0,0 +1,118 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// closedPort returns a local port that nothing is listening on.
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+// TestSubmitStream checks that a streamed output submitted while the server cannot be
+// reached is queued with its digest if it was read, and dropped if it was not.
+func TestSubmitStream(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		send   Policy
+		stream bool // The stream is read and queued.
+	}{
+		{name: "hashed only", send: Never, stream: true},
+		{name: "server unreachable", send: WhenRequired, stream: false},
+	} {
+		dir := t.TempDir()
+		fifo := filepath.Join(dir, "fifo")
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(file, []byte("file contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("streamed contents")
+		if test.stream {
+			go func() {
+				f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+				if err != nil {
+					return
+				}
+				f.Write(data)
+				f.Close()
+			}()
+		}
+
+		c := New("localhost", closedPort(t), &tls.Config{InsecureSkipVerify: true})
+		c.Hashes = []string{"sha256"}
+		c.SendPolicy = test.send
+		c.PendingDir = filepath.Join(dir, "pending")
+		c.Retry = common.Backoff{Attempts: 1}
+		r, err := c.Submit(context.Background(), Submission{Name: "test", Category: "c", Tool: "t", Version: "1"}, []string{"-o", fifo + ",fifo", file + ",file"})
+		if err == nil {
+			t.Errorf("%s: expected error submitting to unreachable server", test.name)
+		}
+		if r == nil || r.Queued == "" {
+			t.Errorf("%s: submission was not queued: %+v", test.name, r)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(r.Queued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e entry
+		if err = json.Unmarshal(b, &e); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{file: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("file contents")))}
+		if test.stream {
+			want[fifo] = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		}
+		if e.ID == "" {
+			t.Errorf("%s: queued submission has no ID", test.name)
+		}
+		if len(e.Links.Outputs) != len(want) || len(e.Paths) != len(want) {
+			t.Errorf("%s: got %d outputs with %d paths queued, want %d", test.name, len(e.Links.Outputs), len(e.Paths), len(want))
+			continue
+		}
+		for i, o := range e.Links.Outputs {
+			if o.Hash != want[e.Paths[i]] {
+				t.Errorf("%s: got digest %q for %q, want %q", test.name, o.Hash, e.Paths[i], want[e.Paths[i]])
+			}
+		}
+	}
+}
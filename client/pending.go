@@ -0,0 +1,303 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// entry is a queued submission. It holds the notification parameters and the hashed
+// files so that the submission can be replayed without rehashing.
+type entry struct {
+	Submission
+
+	Links  *common.Links
+	Paths  []string // Full path of each output, which is not part of the encoding of Links.
+	Failed []string // Descriptions of the copies that failed, if any.
+	Queued time.Time
+
+	file string // Path of the queue entry.
+}
+
+// newEntry returns an entry for the submission s of l.
+func (c *Client) newEntry(s Submission, l *common.Links) *entry {
+	return &entry{Submission: s, Links: l}
+}
+
+// enqueue writes e to the pending queue. Streams are hashed only as they are sent, so a
+// stream that has not been sent cannot be read again and is dropped from the entry.
+func (c *Client) enqueue(e *entry) error {
+	outputs := e.Links.Outputs[:0]
+	e.Paths = e.Paths[:0]
+	for _, o := range e.Links.Outputs {
+		if o.Hash == "" {
+			c.logf("Stream %q was not sent and cannot be queued.", o.OriginalName)
+			continue
+		}
+		outputs = append(outputs, o)
+		e.Paths = append(e.Paths, o.FullPath)
+	}
+	e.Links.Outputs = outputs
+	return e.queue(c.PendingDir)
+}
+
+// result returns the Result of submitting e.
+func (e *entry) result(failed []Failure, pending []string) *Result {
+	return &Result{Submission: e.Submission, Links: e.Links, Failed: failed, Pending: pending, Queued: e.file}
+}
+
+// queue writes e to the pending queue in dir, replacing its previous entry if it has
+// one. The entry is written to a temporary file and renamed into place so that an entry
+// is never seen partially written.
+func (e *entry) queue(dir string) (err error) {
+	if dir == "" {
+		return errors.New("No pending queue.")
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	if e.file == "" {
+		e.Queued = time.Now()
+		e.file = filepath.Join(dir, fmt.Sprintf("%s-%d.json", e.Queued.Format("20060102T150405"), os.Getpid()))
+		for i := 1; ; i++ {
+			if _, err = os.Stat(e.file); os.IsNotExist(err) {
+				break
+			}
+			e.file = filepath.Join(dir, fmt.Sprintf("%s-%d-%d.json", e.Queued.Format("20060102T150405"), os.Getpid(), i))
+		}
+	}
+	b, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".queue-")
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), e.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return
+}
+
+// saveReceipt writes r to a file named by its ID in dir, returning the path of the file.
+func saveReceipt(dir string, r *common.Receipt) (path string, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return
+	}
+	path = filepath.Join(dir, r.ID+".json")
+	if err = ioutil.WriteFile(path, append(b, '\n'), 0600); err != nil {
+		return "", err
+	}
+	return
+}
+
+// remove deletes the queue entry for e.
+func (e *entry) remove() error {
+	if e.file == "" {
+		return nil
+	}
+	return os.Remove(e.file)
+}
+
+// restore returns the hashed files of e with the full path of each output restored.
+func (e *entry) restore() (l *common.Links, err error) {
+	if e.Links == nil || len(e.Paths) != len(e.Links.Outputs) {
+		return nil, errors.New(fmt.Sprintf("Malformed queue entry %q.", e.file))
+	}
+	for i := range e.Links.Outputs {
+		e.Links.Outputs[i].FullPath = e.Paths[i]
+	}
+	return e.Links, nil
+}
+
+// pendingQueue returns the queued submissions in the order they were queued.
+func (c *Client) pendingQueue() (entries []*entry, err error) {
+	if c.PendingDir == "" {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(c.PendingDir, "*.json"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		b, err := ioutil.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+		e := &entry{}
+		if err = json.Unmarshal(b, e); err != nil {
+			c.logf("Skipping malformed queue entry %q: %v", n, err)
+			continue
+		}
+		e.file = n
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// identify chooses an ID for e if it has none. The ID is kept with the queue entry so
+// that the server recognises a replay of a notification it has accepted.
+func (e *entry) identify() (err error) {
+	if e.ID == "" {
+		if e.ID, err = common.NewID(); err != nil {
+			return errors.New(fmt.Sprintf("Could not identify %q: %v", e.Name, err))
+		}
+	}
+	return
+}
+
+// hold writes e to the pending queue after its submission failed with cause, returning
+// an error describing the failure.
+func (c *Client) hold(e *entry, cause error) (r *Result, err error) {
+	if err = e.identify(); err == nil {
+		err = c.enqueue(e)
+	}
+	if err != nil {
+		return e.result(nil, nil), errors.New(fmt.Sprintf("Submission of %q failed and could not be queued: %v: %v", e.Name, cause, err))
+	}
+	return e.result(nil, nil), errors.New(fmt.Sprintf("Submission of %q failed and was queued in %s: %v", e.Name, e.file, cause))
+}
+
+// complete notifies the server of e once its copies have completed. If any copy failed,
+// given by failed, or the notification cannot be sent, e is written to the pending queue
+// for a later Resume; otherwise any queue entry for e is removed.
+func (c *Client) complete(ctx context.Context, e *entry, failed []Failure) (r *Result, err error) {
+	if err = e.identify(); err != nil {
+		return e.result(failed, nil), err
+	}
+	if len(failed) > 0 {
+		e.Failed = e.Failed[:0]
+		for _, f := range failed {
+			e.Failed = append(e.Failed, f.String())
+		}
+		if err = c.enqueue(e); err != nil {
+			return e.result(failed, nil), errors.New(fmt.Sprintf("Could not queue %q: %v", e.Name, err))
+		}
+		c.logf("Notification of %q queued in %s until its copies complete.", e.Name, e.file)
+		return e.result(failed, nil), nil
+	}
+	e.Failed = nil
+	a, pending, err := c.Notify(ctx, e.Submission, e.Links)
+	if err != nil {
+		return c.hold(e, err)
+	}
+	if err = e.remove(); err != nil {
+		c.logf("Could not remove queue entry %q: %v", e.file, err)
+		err = nil
+	}
+	e.file = ""
+	r = e.result(nil, pending)
+	r.Accepted = a
+	if a != nil && a.ID != "" && c.ReceiptDir != "" {
+		if r.Receipt, err = saveReceipt(c.ReceiptDir, &a.Receipt); err != nil {
+			c.logf("Could not save receipt %s of %q: %v", a.ID, e.Name, err)
+			err = nil
+		} else {
+			c.logf("Receipt %s of %q saved in %s.", a.ID, e.Name, r.Receipt)
+		}
+	}
+
+	return r, nil
+}
+
+// Resume replays the pending queue, resending any outputs the server does not hold and
+// notifying the server of each submission. Entries are removed as they succeed. The
+// Result of each replayed submission is returned; a submission that could not be
+// replayed is logged and left in the queue.
+func (c *Client) Resume(ctx context.Context) (results []*Result, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	entries, err := c.pendingQueue()
+	if err != nil {
+		return
+	}
+	if len(entries) == 0 {
+		c.logln("No pending submissions.")
+		return
+	}
+	mode := c.SendPolicy
+	if mode == Never {
+		mode = WhenRequired
+	}
+	for _, e := range entries {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		c.logf("Resuming %q queued at %v.", e.Name, e.Queued.Format(time.RFC3339))
+		l, err := e.restore()
+		if err != nil {
+			c.logln(err)
+			continue
+		}
+		ws, done, alg, encs, err := c.negotiate(ctx, []string{l.Hash})
+		if err != nil {
+			c.logf("Could not resume %q: %v", e.Name, err)
+			continue
+		}
+		if alg != l.Hash {
+			err = errors.New(fmt.Sprintf("server did not accept hash algorithm %s", l.Hash))
+			done(err)
+			c.logf("Could not resume %q: %v.", e.Name, err)
+			continue
+		}
+		failed, err := c.deliver(ctx, mode, ws, done, l, encs)
+		if err != nil {
+			c.logf("Could not resume %q: %v", e.Name, err)
+			continue
+		}
+		r, err := c.complete(ctx, e, failed)
+		if err != nil {
+			c.logln(err)
+			continue
+		}
+		if len(failed) == 0 {
+			c.logf("Submission %q complete.", e.Name)
+		}
+		results = append(results, r)
+	}
+
+	return results, ctx.Err()
+}
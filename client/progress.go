@@ -0,0 +1,270 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// transfer records the progress of a single file being sent to the file server.
+type transfer struct {
+	name  string
+	size  int64 // -1 if not known
+	held  int64 // bytes already held by the server; accessed atomically
+	n     int64 // bytes sent; accessed atomically
+	start time.Time
+	end   time.Time
+	state string
+}
+
+// add records that n more bytes have been sent. It is safe to call on a nil transfer.
+func (t *transfer) add(n int) {
+	if t != nil {
+		atomic.AddInt64(&t.n, int64(n))
+	}
+}
+
+// resume records that the server already holds the first n bytes of the file and
+// restarts the count of bytes sent.
+func (t *transfer) resume(n int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.held, n)
+		atomic.StoreInt64(&t.n, 0)
+	}
+}
+
+// countReader records the bytes read through it in a transfer.
+type countReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (c *countReader) Read(b []byte) (n int, err error) {
+	n, err = c.r.Read(b)
+	c.t.add(n)
+	return
+}
+
+func (t *transfer) sent() int64 { return atomic.LoadInt64(&t.n) }
+
+// rate returns the transfer rate in bytes per second.
+func (t *transfer) rate(now time.Time) float64 {
+	if !t.end.IsZero() {
+		now = t.end
+	}
+	d := now.Sub(t.start).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(t.sent()) / d
+}
+
+// Progress reports the state of the transfers of a Client on a terminal, and logs a
+// summary periodically otherwise. It serialises log output with its reports so that the
+// two are not interleaved.
+type Progress struct {
+	mu        sync.Mutex
+	w         *os.File
+	tty       bool
+	quiet     bool
+	shown     bool // a progress line is displayed on the terminal
+	last      time.Time
+	transfers []*transfer
+	stop      chan struct{}
+}
+
+const (
+	progressInterval = time.Second
+	logInterval      = 30 * time.Second // interval between reports when w is not a terminal
+)
+
+// NewProgress returns a Progress reporting to w. If quiet is true only the summary of
+// transfers is reported.
+func NewProgress(w *os.File, quiet bool) *Progress {
+	p := &Progress{w: w, quiet: quiet, stop: make(chan struct{}), last: time.Now()}
+	if fi, err := w.Stat(); err == nil {
+		p.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	if !quiet {
+		go p.run()
+	}
+	return p
+}
+
+func (p *Progress) run() {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.mu.Lock()
+			p.report(time.Now())
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// start begins recording a transfer of the named file of the given size. A transfer
+// started on a nil Progress is not reported.
+func (p *Progress) start(name string, size int64) (t *transfer) {
+	t = &transfer{name: name, size: size, start: time.Now()}
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.transfers = append(p.transfers, t)
+	p.mu.Unlock()
+	return
+}
+
+// finish marks t as complete with the given state, e.g. "sent" or "failed".
+func (p *Progress) finish(t *transfer, state string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	t.end, t.state = time.Now(), state
+	p.mu.Unlock()
+}
+
+// Write writes b to the underlying file, clearing and redrawing the progress line
+// around it. It allows a Progress to be the output of a log.Logger.
+func (p *Progress) Write(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	return p.w.Write(b)
+}
+
+func (p *Progress) clear() {
+	if p.shown {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// report writes the current progress; p.mu must be held.
+func (p *Progress) report(now time.Time) {
+	var (
+		active      []string
+		done, files int
+		sent, total int64
+		rate        float64
+		unknown     bool
+	)
+	for _, t := range p.transfers {
+		files++
+		n := atomic.LoadInt64(&t.held) + t.sent()
+		sent += n
+		if t.size < 0 {
+			unknown = true
+		} else {
+			total += t.size
+		}
+		if t.end.IsZero() {
+			rate += t.rate(now)
+			if t.size > 0 {
+				active = append(active, fmt.Sprintf("%s %d%%", t.name, 100*n/t.size))
+			} else {
+				active = append(active, fmt.Sprintf("%s %s", t.name, humanBytes(n)))
+			}
+		} else {
+			done++
+		}
+	}
+	if len(active) == 0 {
+		p.clear()
+		return
+	}
+
+	line := fmt.Sprintf("%d/%d files %s", done, files, humanBytes(sent))
+	if !unknown {
+		line += "/" + humanBytes(total)
+	}
+	line += fmt.Sprintf(" %s/s", humanBytes(int64(rate)))
+	if !unknown && rate > 0 {
+		line += fmt.Sprintf(" ETA %v", time.Duration(float64(total-sent)/rate)*time.Second)
+	}
+	line += " | " + strings.Join(active, " | ")
+
+	if p.tty {
+		p.clear()
+		fmt.Fprint(p.w, line)
+		p.shown = true
+	} else if now.Sub(p.last) >= logInterval {
+		fmt.Fprintln(p.w, line)
+		p.last = now
+	}
+}
+
+// Close stops reporting progress.
+func (p *Progress) Close() {
+	if !p.quiet {
+		close(p.stop)
+	}
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+// Summary writes a table describing each transfer to w.
+func (p *Progress) Summary(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.transfers) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "File\tSize\tSent\tTime\tRate\tResult")
+	for _, t := range p.transfers {
+		size := "-"
+		if t.size >= 0 {
+			size = humanBytes(t.size)
+		}
+		end := t.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s/s\t%s\n",
+			t.name, size, humanBytes(t.sent()), end.Sub(t.start)/time.Millisecond*time.Millisecond, humanBytes(int64(t.rate(end))), t.state)
+	}
+	tw.Flush()
+}
+
+// humanBytes returns n as a human readable size.
+func humanBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,627 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Send hashes the files described by args, given as for the command line of transmeta,
+// and sends the outputs to the file server as required by c.SendPolicy, returning the
+// hashed files and any copies that failed after retrying. The server is not notified.
+func (c *Client) Send(ctx context.Context, args []string) (l *common.Links, failed []Failure, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	var (
+		ws   *websocket.Conn
+		done func(error)
+		alg  = c.Hashes[0]
+		encs []string
+	)
+	if c.SendPolicy != Never {
+		if ws, done, alg, encs, err = c.negotiate(ctx, c.Hashes); err != nil {
+			return
+		}
+	}
+	if l, err = c.hash(ctx, alg, args); err != nil {
+		if done != nil {
+			done(err)
+		}
+		return nil, nil, err
+	}
+	failed, err = c.deliver(ctx, c.SendPolicy, ws, done, l, encs)
+
+	return
+}
+
+// hash hashes the files described by args with the hash algorithm alg.
+func (c *Client) hash(ctx context.Context, alg string, args []string) (l *common.Links, err error) {
+	l, err = common.NewLinks(common.Hasher{Hash: alg, Digests: c.Digests, Chunk: c.Chunk, Workers: c.Jobs, Cache: c.Cache}, args)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// negotiate opens a request exchange and agrees a hash algorithm from hashes and the
+// transfer encodings to use with the server. The exchange is finished by calling done.
+func (c *Client) negotiate(ctx context.Context, hashes []string) (ws *websocket.Conn, done func(error), alg string, encs []string, err error) {
+	if ws, done, err = c.exchange(ctx, "request"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = ctxErr(ctx, err)
+			done(err)
+		}
+	}()
+	offer := common.HashOffer{Hashes: hashes, Encodings: c.Encodings}
+	if err = websocket.JSON.Send(ws, offer); err != nil {
+		return
+	}
+	var agreed common.HashOffer
+	if err = c.receiveData(ws, common.KindData, &agreed); err != nil {
+		return
+	}
+	if len(agreed.Hashes) != 1 {
+		err = errors.New(fmt.Sprintf("Bad message: malformed hash agreement %v.", agreed.Hashes))
+		return
+	}
+
+	return ws, done, agreed.Hashes[0], agreed.Encodings, nil
+}
+
+// deliver checks the outputs of l against the server over the negotiated request
+// exchange ws, finishing it with done, and sends them as required by send, returning any
+// copies that failed after retrying. If send is Never, ws and done are not used.
+func (c *Client) deliver(ctx context.Context, send Policy, ws *websocket.Conn, done func(error), l *common.Links, encs []string) (failed []Failure, err error) {
+	var (
+		backends []common.Backend
+		rs       *routes
+	)
+	if send != Never {
+		backends, err = c.check(ws, l, encs)
+		err = ctxErr(ctx, err)
+		done(err)
+		if err != nil {
+			return
+		}
+		if len(backends) == 0 {
+			return nil, errors.New("Could not get file server identity.")
+		}
+		if rs, err = c.chooseRoutes(c.Transports, backends); err != nil {
+			return
+		}
+		rs.encodings = encs
+	}
+
+	// Outputs are sent concurrently; the number of transfers in progress is limited
+	// by slots.
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		ofail = make([][]Failure, len(l.Outputs))
+	)
+	for i := range l.Outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var serr error
+			ofail[i], serr = c.sendOutput(ctx, send, &l.Outputs[i], l.Hash, rs)
+			if serr != nil {
+				mu.Lock()
+				if err == nil {
+					err = serr
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, of := range ofail {
+		failed = append(failed, of...)
+	}
+
+	return failed, ctxErr(ctx, err)
+}
+
+// check sends the outputs of l to the server over the request exchange ws, recording
+// whether the server holds each, and returns the backends the server offers for sending
+// them.
+func (c *Client) check(ws *websocket.Conn, l *common.Links, encs []string) (backends []common.Backend, err error) {
+	// Streams cannot be checked against the server before they are read.
+	var (
+		files []common.Output
+		index []int
+		m     common.Message
+	)
+	for i, o := range l.Outputs {
+		if o.Stream {
+			continue
+		}
+		if len(encs) > 0 && o.Manifest == nil {
+			if ok, _ := common.CompressibleFile(o.FullPath); ok {
+				o.Encoding = encs[0]
+			}
+		}
+		files, index = append(files, o), append(index, i)
+	}
+	if err = websocket.JSON.Send(ws, files); err != nil {
+		return
+	}
+	if m, err = c.receive(ws); err != nil {
+		return
+	} else if m.Kind == common.KindOK {
+		return
+	}
+	if err = m.Decode(&files); err != nil {
+		return
+	} else if len(files) != len(index) {
+		return nil, errors.New(fmt.Sprintf("Bad message: %d files returned for %d sent.", len(files), len(index)))
+	}
+	for j, o := range files {
+		l.Outputs[index[j]] = o
+	}
+
+	if err = c.receiveData(ws, common.KindData, &backends); err != nil {
+		return
+	}
+	return backends, c.receiveOK(ws)
+}
+
+// sendOutput sends the output o to the file server as required by send, returning any
+// copies that failed after retrying.
+func (c *Client) sendOutput(ctx context.Context, send Policy, o *common.Output, alg string, rs *routes) (failed []Failure, err error) {
+	if o.Stream {
+		return nil, c.sendStream(ctx, send, o, alg, rs)
+	}
+	enc := o.Encoding
+	o.Encoding = "" // The encoding is not part of the notification.
+	if o.Sent == nil {
+		// The output was not checked, or the server has warned of a collision.
+		if c.VerifyPolicy == Always {
+			o.Sent = new(bool)
+			*o.Sent = true
+		}
+		return
+	}
+	orig := *o
+	o.Corrupt = nil
+	if o.Manifest != nil && send > Never {
+		c.logf("Copying directory %q to file server...", o.OriginalName)
+		var ok bool
+		failed, ok = c.sendManifest(ctx, send, *o, rs)
+		if ok {
+			c.logf("Copy %q ok.", o.OriginalName)
+			*o.Sent = c.VerifyPolicy != Never
+		} else {
+			c.logf("Copy %q failed.", o.OriginalName)
+			*o.Sent = c.VerifyPolicy == Always
+		}
+		return
+	}
+	if len(orig.Corrupt) > 0 && !*o.Sent && send > Never {
+		c.logf("Resending %d damaged chunks of %q to file server...", len(orig.Corrupt), o.OriginalName)
+		if err := c.Repair(ctx, orig); err != nil {
+			c.logf("Repair of %q failed: %v", o.OriginalName, err)
+		} else {
+			c.logf("Repair of %q ok.", o.OriginalName)
+			*o.Sent = c.VerifyPolicy != Never
+			return nil, nil
+		}
+	}
+	if send == Always || (!*o.Sent && send > Never) {
+		c.logf("Copying %q to file server...", o.OriginalName)
+		if resume, err := c.sendFile(ctx, o.OriginalName, o.FullPath, o.Hash, *o.Size, enc, rs); err != nil {
+			c.logf("Copy %q failed: %v", o.OriginalName, err)
+			failed = append(failed, Failure{Path: o.FullPath, Resume: resume, Err: err})
+			*o.Sent = c.VerifyPolicy == Always
+		} else {
+			c.logf("Copy %q ok.", o.OriginalName)
+			*o.Sent = c.VerifyPolicy != Never
+		}
+	} else {
+		*o.Sent = c.VerifyPolicy == Always
+	}
+
+	return
+}
+
+// sendStream hashes the stream output o as it is copied to the file server, or only
+// hashes it if it is not to be sent. Streams are written to a temporary name and renamed
+// once their digest is known. Streams are sent by the first route that can take them:
+// upload, or ssh to an scp or rsync target. A stream cannot be reread, so there is no
+// fallback to another route, and a failed transfer is only retried if none of the stream
+// had been read.
+func (c *Client) sendStream(ctx context.Context, send Policy, o *common.Output, alg string, rs *routes) (err error) {
+	var r io.Reader = os.Stdin
+	if o.FullPath != "-" {
+		f, err := os.Open(o.FullPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var enc string
+	if send != Never && rs.streamer() == "upload" && len(rs.encodings) > 0 {
+		var ok bool
+		if r, ok = common.CompressibleReader(r); ok {
+			enc = rs.encodings[0]
+		}
+	}
+	algs := common.Hasher{Hash: alg, Digests: c.Digests}.Algorithms()
+	hr, err := common.NewHashReader(r, c.Chunk, algs...)
+	if err != nil {
+		return
+	}
+
+	var (
+		tmp string
+		t   *transfer
+	)
+	if send != Never {
+		c.slots <- struct{}{}
+		defer func() { <-c.slots }()
+		c.logf("Streaming %q to file server...", o.OriginalName)
+		t = c.Progress.start(o.OriginalName, -1)
+		defer func() {
+			if err != nil {
+				c.Progress.finish(t, "failed")
+			} else {
+				c.Progress.finish(t, "streamed")
+			}
+		}()
+	}
+	if send == Never {
+		_, err = io.Copy(ioutil.Discard, hr)
+	} else {
+		err = c.Retry.RetryContext(ctx, func() (err error) {
+			switch {
+			case rs.streamer() == "upload":
+				_, _, err = c.upload(ctx, hr, common.Upload{Name: o.OriginalName, Hash: alg, Encoding: enc}, t)
+			case rs.streamer() != "":
+				b := make([]byte, 8)
+				if _, err = rand.Read(b); err != nil {
+					return
+				}
+				tmp = fmt.Sprintf(".incoming-%x", b)
+				err = common.SecureStream(&countReader{r: hr, t: t}, rs.shell+tmp)
+			default:
+				return common.Permanent(errors.New("No transfer backend can receive streams."))
+			}
+			if err != nil && (t.sent() > 0 || ctx.Err() != nil) {
+				return common.Permanent(err)
+			}
+			return
+		}, func(err error, d time.Duration) {
+			c.logf("Stream %q failed, retrying in %v: %v", o.OriginalName, d, err)
+		})
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Stream %q failed: %v", o.OriginalName, err))
+	}
+
+	d, tree, size := hr.Sum()
+	o.Hash, o.Size = d[0], &size
+	if tree != nil && size > tree.ChunkSize {
+		o.Chunks = tree
+	}
+	if len(algs) > 1 {
+		o.Digests = make(map[string]string)
+		for j, alg := range algs[1:] {
+			o.Digests[alg] = d[j+1]
+		}
+	}
+	o.Sent = new(bool)
+	if send == Never {
+		*o.Sent = c.VerifyPolicy == Always
+		return
+	}
+
+	if tmp != "" {
+		if rs.staged {
+			_, err = c.ingest(ctx, tmp, o.Hash)
+		} else {
+			sn, _ := common.StoreName(o.Hash)
+			err = common.SecureRename(rs.shell+tmp, rs.shell+sn)
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Stream %q failed: %v", o.OriginalName, err))
+		}
+	}
+	c.logf("Stream %q ok.", o.OriginalName)
+	*o.Sent = c.VerifyPolicy != Never
+
+	return
+}
+
+// sendManifest copies the members of the directory output o that the server does not
+// hold, followed by the manifest itself, returning any copies that failed after retrying.
+func (c *Client) sendManifest(ctx context.Context, send Policy, o common.Output, rs *routes) (failed []Failure, ok bool) {
+	var (
+		wg    sync.WaitGroup
+		efail = make([]*Failure, len(o.Manifest.Entries))
+		eok   = make([]bool, len(o.Manifest.Entries))
+	)
+	for i, e := range o.Manifest.Entries {
+		if e.Sent == nil {
+			continue // The server has warned of a collision.
+		}
+		eok[i] = true
+		if send != Always && *e.Sent {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, e common.ManifestEntry) {
+			defer wg.Done()
+			src := filepath.Join(o.FullPath, filepath.FromSlash(e.Path))
+			if resume, err := c.sendFile(ctx, o.OriginalName+"/"+e.Path, src, e.Hash, e.Size, rs.encoding(src), rs); err != nil {
+				c.logf("Copy %q failed: %v", o.OriginalName+"/"+e.Path, err)
+				efail[i] = &Failure{Path: src, Resume: resume, Err: err}
+				eok[i] = false
+			}
+		}(i, e)
+	}
+	wg.Wait()
+	ok = true
+	for i := range eok {
+		if efail[i] != nil {
+			failed = append(failed, *efail[i])
+		}
+		ok = ok && eok[i]
+	}
+	if send != Always && *o.Sent {
+		return
+	}
+
+	f, err := ioutil.TempFile("", "transmeta-manifest-")
+	if err != nil {
+		c.logf("Could not write manifest for %q: %v", o.OriginalName, err)
+		return failed, false
+	}
+	_, err = f.Write(o.Manifest.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.logf("Could not write manifest for %q: %v", o.OriginalName, err)
+		os.Remove(f.Name())
+		return failed, false
+	}
+	defer os.Remove(f.Name())
+	if resume, err := c.sendFile(ctx, o.OriginalName, f.Name(), o.Hash, *o.Size, "", rs); err != nil {
+		c.logf("Copy of manifest for %q failed: %v", o.OriginalName, err)
+		return append(failed, Failure{Path: o.FullPath + " (manifest)", Resume: resume, Err: err}), false
+	}
+
+	return
+}
+
+// uploadFile uploads the named file, which has the digest d and the given size, recording
+// progress in t.
+func (c *Client) uploadFile(ctx context.Context, name, path, d string, size int64, enc string, t *transfer) (resume bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	alg, _, _ := common.ParseDigest(d)
+	got, resume, err := c.upload(ctx, f, common.Upload{Name: name, Hash: alg, Digest: d, Size: size, Encoding: enc}, t)
+	if err == nil && !common.EqualDigests(got, d) {
+		return false, common.Permanent(errors.New(fmt.Sprintf("%q changed while being sent: %s != %s", name, got, d)))
+	}
+	return
+}
+
+// Upload sends the contents of r to the file server in an upload exchange, hashing
+// them with up.Hash as they are sent. If the server already holds part of the contents,
+// that part is read from r but not sent. Upload returns the digest under which the server
+// stored the contents. If resume is true when an error is returned, the server holds the
+// contents sent so far and a later Upload will resume from there.
+func (c *Client) Upload(ctx context.Context, r io.Reader, up common.Upload) (d string, resume bool, err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	return c.upload(ctx, r, up, nil)
+}
+
+// upload is Upload recording progress in t if it is not nil.
+func (c *Client) upload(ctx context.Context, r io.Reader, up common.Upload, t *transfer) (d string, resume bool, err error) {
+	hr, err := common.NewHashReader(r, 0, up.Hash)
+	if err != nil {
+		return
+	}
+	ws, done, err := c.exchange(ctx, "upload")
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = ctxErr(ctx, err)
+		done(err)
+	}()
+	if err = websocket.JSON.Send(ws, up); err != nil {
+		return
+	}
+	var offer common.Upload
+	if err = c.receiveData(ws, common.KindData, &offer); err != nil {
+		return
+	}
+	resume = up.Digest != ""
+	t.resume(offer.Offset)
+	if offer.Offset > 0 {
+		c.logf("Resuming %q at byte %d.", up.Name, offer.Offset)
+		if _, err = io.CopyN(ioutil.Discard, hr, offer.Offset); err != nil {
+			return
+		}
+	}
+
+	bw := &blockWriter{ws: ws, buf: make([]byte, 0, common.UploadBlock)}
+	var w io.Writer = bw
+	var enc io.WriteCloser
+	if up.Encoding != "" {
+		if enc, err = common.NewEncoder(up.Encoding, bw); err != nil {
+			return
+		}
+		w = enc
+	}
+	if _, err = io.Copy(w, &countReader{r: hr, t: t}); err != nil {
+		return
+	}
+	if enc != nil {
+		if err = enc.Close(); err != nil {
+			return
+		}
+	}
+	if err = bw.Close(); err != nil {
+		return
+	}
+	ds, _, _ := hr.Sum()
+	if err = websocket.Message.Send(ws, ds[0]); err != nil {
+		return
+	}
+
+	if err = c.receiveData(ws, common.KindData, &d); err != nil {
+		// The server quarantines a partial file that does not verify, so a
+		// resumed upload can be restarted from the beginning.
+		if rs, ok := r.(io.Seeker); ok && offer.Offset > 0 && common.ErrorCode(err) == common.CodeMismatch {
+			c.logf("Resumed upload of %q failed, restarting: %v", up.Name, err)
+			if err = c.receiveOK(ws); err != nil {
+				return "", false, err
+			}
+			done(nil)
+			if _, err = rs.Seek(0, 0); err != nil {
+				return "", false, err
+			}
+			t.resume(0)
+			return c.upload(ctx, r, up, t)
+		}
+		return "", false, err
+	}
+	resume = false
+	if err = c.receiveOK(ws); err != nil {
+		return "", false, err
+	}
+
+	return
+}
+
+// blockWriter sends the data written to it as binary messages of UploadBlock bytes.
+type blockWriter struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (w *blockWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+c]
+		n += c
+		b = b[c:]
+		if len(w.buf) == cap(w.buf) {
+			if err = websocket.Message.Send(w.ws, w.buf); err != nil {
+				return
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return
+}
+
+// Close sends any buffered data followed by the empty message that ends the contents.
+func (w *blockWriter) Close() (err error) {
+	if len(w.buf) > 0 {
+		if err = websocket.Message.Send(w.ws, w.buf); err != nil {
+			return
+		}
+	}
+	return websocket.Message.Send(w.ws, []byte{})
+}
+
+// Repair resends the chunks of o that the server reports as damaged.
+func (c *Client) Repair(ctx context.Context, o common.Output) (err error) {
+	if err = c.init(); err != nil {
+		return
+	}
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	var size int64
+	for _, i := range o.Corrupt {
+		_, n := o.Chunks.Chunk(i, *o.Size)
+		size += n
+	}
+	t := c.Progress.start(o.OriginalName, size)
+	defer func() {
+		if err != nil {
+			c.Progress.finish(t, "failed")
+		} else {
+			c.Progress.finish(t, "repaired")
+		}
+	}()
+
+	ws, done, err := c.exchange(ctx, "repair")
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = ctxErr(ctx, err)
+		done(err)
+	}()
+	if err = websocket.JSON.Send(ws, o); err != nil {
+		return
+	}
+	var bad []int
+	if err = c.receiveData(ws, common.KindData, &bad); err != nil {
+		return
+	}
+
+	f, err := os.Open(o.FullPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, o.Chunks.ChunkSize)
+	for _, i := range bad {
+		off, n := o.Chunks.Chunk(i, *o.Size)
+		if _, err = f.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			return
+		}
+		if err = websocket.Message.Send(ws, buf[:n]); err != nil {
+			return
+		}
+		t.add(int(n))
+	}
+
+	return c.receiveOK(ws)
+}
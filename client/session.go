@@ -0,0 +1,143 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"context"
+	"errors"
+	"sync"
+)
+
+// session is a /session connection to the server over which the exchanges of a Client
+// are made in turn, so that many submissions pay for a single TLS handshake.
+type session struct {
+	// idle holds the connection, or nil if it is not yet connected, while no
+	// exchange is running over it.
+	idle chan *websocket.Conn
+	off  bool // the server does not offer sessions
+}
+
+var errNoSession = errors.New("Server does not offer sessions.")
+
+func newSession() *session {
+	s := &session{idle: make(chan *websocket.Conn, 1)}
+	s.idle <- nil
+	return s
+}
+
+// start names the exchange with the given endpoint to the server over the session
+// connection ws, connecting the session first if ws is nil.
+func (s *session) start(ctx context.Context, c *Client, ws *websocket.Conn, endpoint string) (_ *websocket.Conn, err error) {
+	if s.off {
+		return nil, errNoSession
+	}
+	if ws == nil {
+		if ws, err = c.dial(ctx, "session"); err != nil {
+			if de, ok := err.(*websocket.DialError); ok && de.Err == websocket.ErrBadStatus {
+				s.off = true
+			}
+			return nil, err
+		}
+		if _, err = hello(ws); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	if err = websocket.JSON.Send(ws, common.Session{Exchange: endpoint}); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// close closes the session connection once the exchanges running over it are finished.
+func (s *session) close() {
+	if ws := <-s.idle; ws != nil {
+		ws.Close()
+	}
+	s.idle <- nil
+}
+
+// exchange opens the exchange with the named endpoint of the server, returning the
+// connection to run it over and a function to call with its outcome when it is finished.
+// The exchange is run over the session if it is idle and over a connection of its own
+// otherwise, so concurrent transfers are not held up. A session connection is dropped
+// when an exchange fails, since the exchange may have been left unfinished. The
+// connection is closed if ctx is done before the exchange is finished.
+func (c *Client) exchange(ctx context.Context, endpoint string) (ws *websocket.Conn, done func(err error), err error) {
+	s := c.sess
+	select {
+	case ws = <-s.idle:
+		if ws, err = s.start(ctx, c, ws, endpoint); err == nil {
+			return ws, watch(ctx, ws, func(err error) {
+				if err != nil {
+					ws.Close()
+					ws = nil
+				}
+				s.idle <- ws
+			}), nil
+		}
+		off := s.off
+		s.idle <- nil
+		if !off {
+			return nil, nil, ctxErr(ctx, err)
+		}
+	default:
+	}
+
+	if ws, err = c.dial(ctx, endpoint); err != nil {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	if _, err = hello(ws); err != nil {
+		ws.Close()
+		return nil, nil, err
+	}
+	return ws, watch(ctx, ws, func(error) { ws.Close() }), nil
+}
+
+// watch closes ws if ctx is done before the returned function is called, and returns a
+// function that calls end with the outcome of the exchange over ws the first time it is
+// called. The outcome is the error of ctx if ws was closed.
+func watch(ctx context.Context, ws *websocket.Conn, end func(err error)) func(err error) {
+	var (
+		quit   = make(chan struct{})
+		closed = make(chan bool, 1)
+		once   sync.Once
+	)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+			closed <- true
+		case <-quit:
+			closed <- false
+		}
+	}()
+	return func(err error) {
+		once.Do(func() {
+			close(quit)
+			if <-closed && err == nil {
+				err = ctx.Err()
+			}
+			end(err)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// route is a means of sending files to the file server, chosen from the backends that
+// the server advertises.
+type route struct {
+	name      string
+	transport common.Transport // nil for the upload backend
+	staged    bool             // copies must be ingested by the server
+}
+
+// routes holds the routes to the file server in order of preference.
+type routes struct {
+	order     []route
+	shell     string   // scp target for streaming over ssh; empty if none
+	staged    bool     // streams sent to shell must be ingested by the server
+	encodings []string // transfer encodings agreed with the server
+}
+
+// encoding returns the transfer encoding to use for the named file, or the empty string
+// if it should not be compressed.
+func (rs *routes) encoding(name string) string {
+	if len(rs.encodings) == 0 {
+		return ""
+	}
+	if ok, _ := common.CompressibleFile(name); !ok {
+		return ""
+	}
+	return rs.encodings[0]
+}
+
+// chooseRoutes returns the routes named by prefs, in that order, that are supported by
+// the advertised backends bs. The name "link" selects the local backend using hardlinks.
+func (c *Client) chooseRoutes(prefs []string, bs []common.Backend) (rs *routes, err error) {
+	rs = &routes{}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c.TLS}}
+	for _, p := range prefs {
+		name := p
+		if p == "link" {
+			name = "local"
+		}
+		b, ok := common.FindBackend(bs, name)
+		if !ok {
+			continue
+		}
+		r := route{name: p, staged: b.Staged}
+		if name != "upload" {
+			if r.transport, err = common.NewTransport(b, p == "link", client); err != nil {
+				return nil, err
+			}
+		}
+		rs.order = append(rs.order, r)
+	}
+	for _, name := range []string{"scp", "rsync"} {
+		if b, ok := common.FindBackend(bs, name); ok {
+			rs.shell, rs.staged = b.Target, b.Staged
+			break
+		}
+	}
+	if len(rs.order) == 0 {
+		var offered []string
+		for _, b := range bs {
+			offered = append(offered, b.Name)
+		}
+		return nil, errors.New(fmt.Sprintf("No acceptable transfer backend - server offers %s.", strings.Join(offered, ", ")))
+	}
+	return
+}
+
+// streamer returns the name of the first route able to receive a stream, or the empty
+// string if there is none.
+func (rs *routes) streamer() string {
+	for _, r := range rs.order {
+		switch r.name {
+		case "upload":
+			return r.name
+		case "scp", "rsync":
+			if rs.shell != "" {
+				return r.name
+			}
+		}
+	}
+	return ""
+}
+
+// sendFile copies the named file, which has the digest d and the given size, to the
+// file server, trying each route in turn and retrying with backoff while the failure may
+// be transient. Routes that can compress in transit use the transfer encoding enc if it
+// is not empty. If resume is true the server holds part of the file and a later
+// submission will resume the upload.
+func (c *Client) sendFile(ctx context.Context, name, path, d string, size int64, enc string, rs *routes) (resume bool, err error) {
+	if _, err = common.StoreName(d); err != nil {
+		return
+	}
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	t := c.Progress.start(name, size)
+	defer func() {
+		switch {
+		case err == nil && t.held > 0:
+			c.Progress.finish(t, "resumed")
+		case err == nil:
+			c.Progress.finish(t, "sent")
+		case resume:
+			c.Progress.finish(t, "interrupted")
+		default:
+			c.Progress.finish(t, "failed")
+		}
+	}()
+	err = c.Retry.RetryContext(ctx, func() (err error) {
+		// An attempt fails permanently only if every route failed permanently.
+		permanent := true
+		for i, r := range rs.order {
+			if i > 0 {
+				c.logf("Copy of %q by %s failed, trying %s: %v", name, rs.order[i-1].name, r.name, err)
+			}
+			if r.transport != nil {
+				if et, ok := r.transport.(common.EncodingTransport); ok && enc != "" {
+					err = et.SendEncoded(path, d, enc)
+				} else {
+					err = r.transport.Send(path, d)
+				}
+				if err == nil && r.staged {
+					sn, _ := common.StoreName(d)
+					_, err = c.ingest(ctx, sn, d)
+				}
+				if err == nil {
+					t.add(int(size))
+					return
+				}
+			} else {
+				// The upload route resumes from the data held by the server, so
+				// there is no point in trying other routes if it was interrupted.
+				if resume, err = c.uploadFile(ctx, name, path, d, size, enc, t); err == nil || resume {
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			permanent = permanent && common.IsPermanent(err)
+		}
+		if permanent {
+			return common.Permanent(err)
+		}
+		if p, ok := err.(*common.PermanentError); ok {
+			return p.Err
+		}
+		return
+	}, func(err error, wait time.Duration) {
+		c.logf("Copy of %q failed, retrying in %v: %v", name, wait, err)
+	})
+	return
+}
+
+// ingest asks the server to verify the file copied to its staging area under the given
+// name and move it into the store, returning the digest under which it was stored.
+func (c *Client) ingest(ctx context.Context, name, d string) (stored string, err error) {
+	ws, done, err := c.exchange(ctx, "ingest")
+	if err != nil {
+		return
+	}
+	defer func() { done(err) }()
+	if err = websocket.JSON.Send(ws, common.Ingest{Name: name, Digest: d}); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	if err = c.receiveData(ws, common.KindData, &stored); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	if err = c.receiveOK(ws); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+
+	return
+}
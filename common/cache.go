@@ -0,0 +1,301 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// HashCache is a persistent record of file digests keyed by device, inode, size and
+// modification time. A nil *HashCache is valid and caches nothing.
+type HashCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	dirty   bool
+	pruned  bool
+}
+
+type cacheKey struct {
+	Dev, Ino uint64
+	Hash     string
+}
+
+type cacheEntry struct {
+	Path     string
+	Dev, Ino uint64
+	Size     int64
+	Mtime    int64
+	Hash     string
+	Digest   string
+	Tree     *MerkleTree `json:",omitempty"` // Chunk digests of a large file using Hash.
+}
+
+func (e cacheEntry) key() cacheKey { return cacheKey{Dev: e.Dev, Ino: e.Ino, Hash: e.Hash} }
+
+// OpenHashCache reads the hash cache stored at path. A missing file gives an empty cache.
+func OpenHashCache(path string) (c *HashCache, err error) {
+	c = &HashCache{path: path, entries: make(map[cacheKey]cacheEntry)}
+	if err = c.read(func(e cacheEntry) { c.entries[e.key()] = e }); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *HashCache) read(fn func(cacheEntry)) (err error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e cacheEntry
+		if err = dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = errors.New(fmt.Sprintf("Corrupt hash cache %q: %v", c.path, err))
+			}
+			return
+		}
+		fn(e)
+	}
+}
+
+func stat(name string) (e cacheEntry, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return e, errors.New(fmt.Sprintf("Cannot get inode for %q", name))
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return cacheEntry{
+		Path:  name,
+		Dev:   uint64(st.Dev),
+		Ino:   st.Ino,
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+	}, nil
+}
+
+// Lookup returns the cached digest of the named file for the hash algorithm alg.
+func (c *HashCache) Lookup(alg, name string) (d string, size int64, ok bool) {
+	ce, ok := c.lookup(alg, name)
+	if !ok {
+		return "", 0, false
+	}
+	return ce.Digest, ce.Size, true
+}
+
+// lookup returns the cache entry of the named file for the hash algorithm alg if the
+// file has not changed since it was cached.
+func (c *HashCache) lookup(alg, name string) (ce cacheEntry, ok bool) {
+	if c == nil {
+		return
+	}
+	e, err := stat(name)
+	if err != nil {
+		return
+	}
+	e.Hash = alg
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ce, ok = c.entries[e.key()]
+	if !ok || ce.Size != e.Size || ce.Mtime != e.Mtime {
+		return cacheEntry{}, false
+	}
+	return ce, true
+}
+
+// HashFile is HashFile with results read from and recorded in the cache. Only the
+// digests missing from the cache are computed.
+func (c *HashCache) HashFile(name string, algs ...string) (digests []string, size int64, err error) {
+	if c == nil {
+		return HashFile(name, algs...)
+	}
+
+	digests = make([]string, len(algs))
+	var (
+		missing []string
+		index   []int
+	)
+	for i, alg := range algs {
+		var ok bool
+		if digests[i], size, ok = c.Lookup(alg, name); !ok {
+			missing = append(missing, alg)
+			index = append(index, i)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	e, serr := stat(name)
+	found, size, err := HashFile(name, missing...)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, d := range found {
+		digests[index[i]] = d
+	}
+	if serr == nil {
+		c.record(name, e, missing, found, nil)
+	}
+
+	return
+}
+
+// HashFileTree is HashFileTree with digests and the tree read from and recorded in the
+// cache. The tree is cached with the digest of the first of algs, so the file is read
+// again only if a digest or a tree with the given chunk size is missing. Files no larger
+// than chunk are not given a tree.
+func (c *HashCache) HashFileTree(name string, chunk int64, algs ...string) (digests []string, tree *MerkleTree, size int64, err error) {
+	e, serr := stat(name)
+	if chunk <= 0 || (serr == nil && e.Size <= chunk) {
+		digests, size, err = c.HashFile(name, algs...)
+		return
+	}
+	if c != nil && len(algs) > 0 {
+		if ce, ok := c.lookup(algs[0], name); ok && ce.Tree != nil && ce.Tree.ChunkSize == chunk {
+			digests = make([]string, len(algs))
+			for i, alg := range algs {
+				if digests[i], size, ok = c.Lookup(alg, name); !ok {
+					break
+				}
+			}
+			if ok {
+				return digests, ce.Tree, size, nil
+			}
+		}
+	}
+	if digests, tree, size, err = HashFileTree(name, chunk, algs...); err != nil {
+		return
+	}
+	if c != nil && serr == nil {
+		c.record(name, e, algs, digests, tree)
+	}
+	return
+}
+
+// record stores digests, and the tree of the first of algs if it is not nil, for the file
+// described by e unless it has changed since e was obtained.
+func (c *HashCache) record(name string, e cacheEntry, algs, digests []string, tree *MerkleTree) {
+	if after, err := stat(name); err != nil || after.Size != e.Size || after.Mtime != e.Mtime {
+		return // Changed while hashing - don't cache.
+	}
+
+	c.mu.Lock()
+	for i, alg := range algs {
+		e.Hash, e.Digest, e.Tree = alg, digests[i], nil
+		if ce, ok := c.entries[e.key()]; ok && ce.Size == e.Size && ce.Mtime == e.Mtime {
+			e.Tree = ce.Tree
+		}
+		if i == 0 && tree != nil {
+			e.Tree = tree
+		}
+		c.entries[e.key()] = e
+	}
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+// Prune removes entries for files that no longer exist or have changed since they were
+// cached, returning the number of entries removed.
+func (c *HashCache) Prune() (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, ce := range c.entries {
+		if e, err := stat(ce.Path); err != nil || e.Dev != ce.Dev || e.Ino != ce.Ino || e.Size != ce.Size || e.Mtime != ce.Mtime {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	c.dirty, c.pruned = c.dirty || n > 0, true
+	return
+}
+
+// Save writes the cache back to its file. Unless the cache has been pruned, entries
+// written by other processes since the cache was opened are retained.
+func (c *HashCache) Save() (err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return
+	}
+
+	if !c.pruned {
+		if err = c.read(func(e cacheEntry) {
+			if _, ok := c.entries[e.key()]; !ok {
+				c.entries[e.key()] = e
+			}
+		}); err != nil {
+			return
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range c.entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err = os.Rename(f.Name(), c.path); err != nil {
+		return
+	}
+	c.dirty = false
+
+	return
+}
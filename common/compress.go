@@ -0,0 +1,104 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"github.com/klauspost/compress/zstd"
+
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Encodings lists the transfer encodings available, in order of preference.
+var Encodings = []string{"zstd", "gzip"}
+
+// sampleLen is the length of the leading sample used to decide whether a file is worth
+// compressing.
+const sampleLen = 64 << 10
+
+// Compressible reports whether the sample b, taken from the start of a file, compresses
+// well enough for the file to be sent compressed.
+func Compressible(b []byte) bool {
+	if len(b) > sampleLen {
+		b = b[:sampleLen]
+	}
+	if len(b) < 512 {
+		return false
+	}
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	w.Write(b)
+	w.Close()
+	return buf.Len() < len(b)*9/10
+}
+
+// CompressibleFile reports whether the named file is worth compressing in transit.
+func CompressibleFile(name string) (ok bool, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, fileError(name, err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, sampleLen))
+	if err != nil {
+		return false, fileError(name, err)
+	}
+	return Compressible(b), nil
+}
+
+// CompressibleReader returns a Reader with the contents of r and reports whether they
+// are worth compressing in transit, judged by a sample read from the start of r.
+func CompressibleReader(r io.Reader) (io.Reader, bool) {
+	br := bufio.NewReaderSize(r, sampleLen)
+	b, _ := br.Peek(sampleLen)
+	return br, Compressible(b)
+}
+
+// NewEncoder returns a WriteCloser that compresses data written to it with the named
+// encoding and writes it to w. Closing the encoder does not close w.
+func NewEncoder(enc string, w io.Writer) (wc io.WriteCloser, err error) {
+	switch enc {
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown encoding: %q", enc))
+}
+
+// NewDecoder returns a ReadCloser that decompresses data read from r with the named
+// encoding. Closing the decoder does not close r.
+func NewDecoder(enc string, r io.Reader) (rc io.ReadCloser, err error) {
+	switch enc {
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown encoding: %q", enc))
+}
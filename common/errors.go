@@ -0,0 +1,96 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MissingError is returned when a named file does not exist.
+type MissingError struct {
+	Name string
+}
+
+func (e *MissingError) Error() string { return fmt.Sprintf("%s: no such file", e.Name) }
+
+// DirectoryError is returned when a regular file is required but a directory is named.
+type DirectoryError struct {
+	Name string
+}
+
+func (e *DirectoryError) Error() string { return fmt.Sprintf("%s is a directory", e.Name) }
+
+// PermissionError is returned when a named file cannot be accessed.
+type PermissionError struct {
+	Name string
+	Err  error
+}
+
+func (e *PermissionError) Error() string { return fmt.Sprintf("%s: permission denied", e.Name) }
+
+// CollisionError is returned when a stored file has the name expected for a digest
+// but does not have the expected contents or size.
+type CollisionError struct {
+	Name string
+	Hash string
+	Size int64
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%s collides with stored file for %s (size %d)", e.Name, e.Hash, e.Size)
+}
+
+// ArgumentError is returned for a malformed file argument.
+type ArgumentError struct {
+	Arg    string
+	Reason string
+}
+
+func (e *ArgumentError) Error() string {
+	if e.Arg == "" {
+		return e.Reason + "."
+	}
+	return fmt.Sprintf("%s: %q", e.Reason, e.Arg)
+}
+
+// FileErrors holds the errors for a set of files, in argument order.
+type FileErrors []error
+
+func (e FileErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// fileError converts an error returned by the os package for name into one of the
+// file error types where possible.
+func fileError(name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return &MissingError{Name: name}
+	case os.IsPermission(err):
+		return &PermissionError{Name: name, Err: err}
+	}
+	return err
+}
@@ -18,55 +18,330 @@ along with this program.  If not, see <http:www.gnu.org/licenses/>.
 package common
 
 import (
+	"golang.org/x/crypto/blake2b"
+
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"log"
 	"os"
+	"sort"
+	"strings"
 )
 
-var HashFunc = sha1.New()
+// LegacyHash is the algorithm assumed for digests that carry no algorithm prefix.
+const LegacyHash = "sha1"
 
-var bufferLen = 4096
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha1":    sha1.New,
+	"sha256":  sha256.New,
+	"sha512":  sha512.New,
+	"blake2b": newBlake2b,
+}
+
+func newBlake2b() hash.Hash {
+	h, _ := blake2b.New512(nil) // Cannot fail without a key.
+	return h
+}
+
+// RegisterHash makes the hash algorithm name available to NewHash. It is not safe to
+// call RegisterHash concurrently with other functions in this package.
+func RegisterHash(name string, f func() hash.Hash) (err error) {
+	if name == "" || strings.ContainsAny(name, ":-,") {
+		return errors.New(fmt.Sprintf("Illegal hash name: %q", name))
+	}
+	hashFuncs[name] = f
+	return
+}
+
+// NewHash returns a new hash.Hash for the named algorithm.
+func NewHash(alg string) (h hash.Hash, err error) {
+	f, ok := hashFuncs[alg]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown hash algorithm: %q", alg))
+	}
+	return f(), nil
+}
 
-func HashFile(h hash.Hash, name string) (s string, size int64) {
-	if f, err := os.Open(name); err != nil {
-		log.Fatalf("Error: %v\n", err)
-	} else if sum, err := Hash(h, f); err != nil {
-		log.Fatalf("Error: %v\n", err)
+// Hashes returns the names of the available hash algorithms.
+func Hashes() (names []string) {
+	for n := range hashFuncs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Digest returns the algorithm-prefixed text form of sum, e.g. "sha256:e3b0...".
+func Digest(alg string, sum []byte) string {
+	return fmt.Sprintf("%s:%x", alg, sum)
+}
+
+// ParseDigest splits a digest into its algorithm and hex sum. Digests without
+// an algorithm prefix are legacy SHA-1 digests.
+func ParseDigest(d string) (alg, sum string, err error) {
+	if i := strings.Index(d, ":"); i < 0 {
+		alg, sum = LegacyHash, d
 	} else {
-		s = fmt.Sprintf("%x", sum)
-		fi, err := f.Stat()
-		if err != nil {
-			log.Fatalf("Error: %v\n", err)
+		alg, sum = d[:i], d[i+1:]
+	}
+	h, err := NewHash(alg)
+	if err != nil {
+		return "", "", err
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != h.Size() {
+		return "", "", errors.New(fmt.Sprintf("Malformed %s digest: %q", alg, d))
+	}
+	return
+}
+
+// StoreName returns the file name used to store content with the digest d. SHA-1
+// content is stored under its bare hex sum so that legacy stores remain valid.
+func StoreName(d string) (name string, err error) {
+	alg, sum, err := ParseDigest(d)
+	if err != nil {
+		return
+	}
+	if alg == LegacyHash {
+		return sum, nil
+	}
+	return alg + "-" + sum, nil
+}
+
+// ParseStoreName returns the digest of the content stored under the file name sn. It is
+// the inverse of StoreName.
+func ParseStoreName(sn string) (d string, err error) {
+	if i := strings.Index(sn, "-"); i >= 0 {
+		d = sn[:i] + ":" + sn[i+1:]
+	} else {
+		d = sn
+	}
+	if _, _, err = ParseDigest(d); err != nil {
+		return "", err
+	}
+	if name, _ := StoreName(d); name != sn {
+		return "", errors.New(fmt.Sprintf("Illegal store name: %q", sn))
+	}
+	return
+}
+
+// EqualDigests reports whether a and b are the same digest.
+func EqualDigests(a, b string) bool {
+	aa, as, err := ParseDigest(a)
+	if err != nil {
+		return false
+	}
+	ba, bs, err := ParseDigest(b)
+	if err != nil {
+		return false
+	}
+	return aa == ba && strings.EqualFold(as, bs)
+}
+
+// HashOffer lists hash algorithms and transfer encodings in order of preference. It opens
+// a /request exchange and the server replies with a HashOffer holding the single agreed
+// algorithm and the offered encodings that it accepts.
+type HashOffer struct {
+	Hashes    []string
+	Encodings []string `json:",omitempty"`
+}
+
+// Negotiate returns the first algorithm in offered that is also in accepted.
+func Negotiate(offered, accepted []string) (alg string, ok bool) {
+	for _, o := range offered {
+		for _, a := range accepted {
+			if o == a {
+				return o, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Hasher describes how a set of files is hashed.
+type Hasher struct {
+	Hash    string     // Hash algorithm.
+	Digests []string   // Additional hash algorithms recorded for outputs.
+	Chunk   int64      // Chunk size for output Merkle trees; zero disables trees.
+	Workers int        // Number of files hashed concurrently.
+	Cache   *HashCache // Optional digest cache.
+}
+
+// Algorithms returns the hash algorithm of h followed by each additional algorithm that
+// is not already listed, so that no digest is computed twice.
+func (h Hasher) Algorithms() []string {
+	algs := []string{h.Hash}
+	seen := map[string]bool{h.Hash: true}
+	for _, alg := range h.Digests {
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
 		}
-		size = fi.Size()
 	}
+	return algs
+}
+
+var bufferLen = 4096
+
+// HashFile returns the algorithm-prefixed digests of the named file for each of the
+// hash algorithms in algs, computed in a single read, and the size of the file.
+func HashFile(name string, algs ...string) (digests []string, size int64, err error) {
+	return hashFile(name, algs, nil)
+}
+
+// HashFileTree is HashFile that also builds a MerkleTree over chunks of the file in the
+// same read, using the first of algs.
+func HashFileTree(name string, chunk int64, algs ...string) (digests []string, tree *MerkleTree, size int64, err error) {
+	if len(algs) == 0 {
+		return nil, nil, 0, errors.New("No hash algorithm specified.")
+	}
+	mw, err := newMerkleWriter(algs[0], chunk)
+	if err != nil {
+		return
+	}
+	if digests, size, err = hashFile(name, algs, mw); err != nil {
+		return
+	}
+	return digests, mw.finish(), size, nil
+}
+
+func hashFile(name string, algs []string, extra io.Writer) (digests []string, size int64, err error) {
+	hs := make([]hash.Hash, len(algs))
+	for i, alg := range algs {
+		if hs[i], err = NewHash(alg); err != nil {
+			return
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, fileError(name, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, fileError(name, err)
+	}
+	sums, err := hashWith(f, extra, hs...)
+	if err != nil {
+		return nil, 0, fileError(name, err)
+	}
+	for i, sum := range sums {
+		digests = append(digests, Digest(algs[i], sum))
+	}
+
+	return digests, fi.Size(), nil
+}
+
+// HashReader hashes the data read through it.
+type HashReader struct {
+	r    io.Reader
+	algs []string
+	hs   []hash.Hash
+	mw   *merkleWriter
+	w    io.Writer
+	n    int64
+}
 
+// NewHashReader returns a HashReader that reads from r and hashes with each of algs. If
+// chunk is positive a MerkleTree is also built using the first of algs.
+func NewHashReader(r io.Reader, chunk int64, algs ...string) (hr *HashReader, err error) {
+	if len(algs) == 0 {
+		return nil, errors.New("No hash algorithm specified.")
+	}
+	hr = &HashReader{r: r, algs: algs, hs: make([]hash.Hash, len(algs))}
+	ws := make([]io.Writer, len(algs), len(algs)+1)
+	for i, alg := range algs {
+		if hr.hs[i], err = NewHash(alg); err != nil {
+			return nil, err
+		}
+		ws[i] = hr.hs[i]
+	}
+	if chunk > 0 {
+		if hr.mw, err = newMerkleWriter(algs[0], chunk); err != nil {
+			return nil, err
+		}
+		ws = append(ws, hr.mw)
+	}
+	hr.w = io.MultiWriter(ws...)
 	return
 }
 
-func Hash(h hash.Hash, file *os.File) (sum []byte, err error) {
+func (hr *HashReader) Read(b []byte) (n int, err error) {
+	n, err = hr.r.Read(b)
+	hr.w.Write(b[:n])
+	hr.n += int64(n)
+	return
+}
+
+// Sum returns the digests of the data read so far, its Merkle tree if one was requested
+// and its size. Sum must only be called once reading is complete.
+func (hr *HashReader) Sum() (digests []string, tree *MerkleTree, size int64) {
+	for i, h := range hr.hs {
+		digests = append(digests, Digest(hr.algs[i], h.Sum(nil)))
+	}
+	if hr.mw != nil {
+		tree = hr.mw.finish()
+	}
+	return digests, tree, hr.n
+}
+
+// IsStream reports whether name is "-", meaning standard input, or a named pipe.
+// Streams can only be read once and so are hashed as they are sent.
+func IsStream(name string) bool {
+	if name == "-" {
+		return true
+	}
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// Hash feeds the contents of file through each of hs in a single read and returns
+// the resulting sums in the order of hs.
+func Hash(file *os.File, hs ...hash.Hash) (sums [][]byte, err error) {
+	return hashWith(file, nil, hs...)
+}
+
+func hashWith(file *os.File, extra io.Writer, hs ...hash.Hash) (sums [][]byte, err error) {
 	var fi os.FileInfo
-	if fi, err = file.Stat(); err != nil || fi.IsDir() {
-		return nil, errors.New(fmt.Sprintf("%s is a directory", file))
+	if fi, err = file.Stat(); err != nil {
+		return
+	} else if fi.IsDir() {
+		return nil, &DirectoryError{Name: file.Name()}
 	}
 
-	file.Seek(0, 0)
+	if _, err = file.Seek(0, 0); err != nil {
+		return
+	}
 
+	ws := make([]io.Writer, len(hs), len(hs)+1)
+	for i, h := range hs {
+		ws[i] = h
+	}
+	if extra != nil {
+		ws = append(ws, extra)
+	}
+	w := io.MultiWriter(ws...)
 	for n, buffer := 0, make([]byte, bufferLen); err == nil || err == io.ErrUnexpectedEOF; {
 		n, err = io.ReadAtLeast(file, buffer, bufferLen)
-		h.Write(buffer[:n])
+		w.Write(buffer[:n])
 	}
 
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		err = nil
+	} else {
+		return nil, err
 	}
 
-	sum = h.Sum(nil)
-	h.Reset()
+	for _, h := range hs {
+		sums = append(sums, h.Sum(nil))
+		h.Reset()
+	}
 
 	return
 }
@@ -0,0 +1,133 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	emptySHA1   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestParseDigest(t *testing.T) {
+	for _, test := range []struct {
+		d        string
+		alg, sum string
+		fail     bool
+	}{
+		{d: "sha256:" + emptySHA256, alg: "sha256", sum: emptySHA256},
+		{d: "sha1:" + emptySHA1, alg: "sha1", sum: emptySHA1},
+		{d: emptySHA1, alg: LegacyHash, sum: emptySHA1},
+		{d: "sha256:" + strings.ToUpper(emptySHA256), alg: "sha256", sum: strings.ToUpper(emptySHA256)},
+		{d: "sha256:" + emptySHA1, fail: true},
+		{d: "sha256:" + emptySHA256[:63] + "g", fail: true},
+		{d: "nohash:" + emptySHA256, fail: true},
+		{d: "sha256:", fail: true},
+		{d: "", fail: true},
+		{d: emptySHA256, fail: true}, // a bare digest is SHA-1
+	} {
+		alg, sum, err := ParseDigest(test.d)
+		if (err != nil) != test.fail {
+			t.Errorf("%q: unexpected error state: %v", test.d, err)
+			continue
+		}
+		if alg != test.alg || sum != test.sum {
+			t.Errorf("%q: got %q %q, want %q %q", test.d, alg, sum, test.alg, test.sum)
+		}
+	}
+}
+
+func TestStoreName(t *testing.T) {
+	for _, test := range []struct {
+		d, sn string
+	}{
+		{d: "sha256:" + emptySHA256, sn: "sha256-" + emptySHA256},
+		{d: "sha1:" + emptySHA1, sn: emptySHA1},
+		{d: emptySHA1, sn: emptySHA1},
+	} {
+		sn, err := StoreName(test.d)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.d, err)
+			continue
+		}
+		if sn != test.sn {
+			t.Errorf("%q: got store name %q, want %q", test.d, sn, test.sn)
+		}
+		d, err := ParseStoreName(sn)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", sn, err)
+			continue
+		}
+		if !EqualDigests(d, test.d) {
+			t.Errorf("%q: got digest %q, want %q", sn, d, test.d)
+		}
+	}
+}
+
+func TestParseStoreName(t *testing.T) {
+	for _, sn := range []string{
+		"",
+		"sha1-" + emptySHA1, // SHA-1 is stored under its bare sum
+		"sha256:" + emptySHA256,
+		"sha256-" + emptySHA256 + "-x",
+		"../sha256-" + emptySHA256,
+		"sha256-" + emptySHA1,
+		".partial-sha256-" + emptySHA256,
+		"md6-" + emptySHA256,
+	} {
+		if d, err := ParseStoreName(sn); err == nil {
+			t.Errorf("%q: expected error, got digest %q", sn, d)
+		}
+	}
+}
+
+func TestEqualDigests(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{a: "sha1:" + emptySHA1, b: emptySHA1, equal: true},
+		{a: "sha256:" + emptySHA256, b: "sha256:" + strings.ToUpper(emptySHA256), equal: true},
+		{a: "sha256:" + emptySHA256, b: "sha256:" + emptySHA256[:63] + "0", equal: false},
+		{a: "sha256:" + emptySHA256, b: "sha1:" + emptySHA1, equal: false},
+		{a: "bad", b: "bad", equal: false},
+	} {
+		if got := EqualDigests(test.a, test.b); got != test.equal {
+			t.Errorf("EqualDigests(%q, %q) = %t, want %t", test.a, test.b, got, test.equal)
+		}
+	}
+}
+
+func TestHasherAlgorithms(t *testing.T) {
+	for _, test := range []struct {
+		h    Hasher
+		want []string
+	}{
+		{h: Hasher{Hash: "sha256"}, want: []string{"sha256"}},
+		{h: Hasher{Hash: "sha256", Digests: []string{"md5", "sha1"}}, want: []string{"sha256", "md5", "sha1"}},
+		{h: Hasher{Hash: "sha256", Digests: []string{"md5", "sha256", "md5"}}, want: []string{"sha256", "md5"}},
+	} {
+		if got := test.h.Algorithms(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: got algorithms %v, want %v", test.h, got, test.want)
+		}
+	}
+}
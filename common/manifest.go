@@ -0,0 +1,179 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Manifest lists the regular files below a directory output. Its canonical form, as
+// returned by Bytes, is stored on the server under its own digest, and each listed
+// file is stored under the digest recorded in its entry.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// ManifestEntry describes a single file in a Manifest.
+type ManifestEntry struct {
+	Path string // Slash-separated path relative to the directory.
+	Hash string
+	Size int64
+	Sent *bool `json:",omitempty"`
+}
+
+// NewManifest walks dir and hashes each regular file below it as specified by h. Symbolic
+// links to regular files are followed; other non-regular files are an error.
+func NewManifest(h Hasher, dir string) (m *Manifest, err error) {
+	var (
+		jobs []hashJob
+		errs FileErrors
+	)
+	m = &Manifest{}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, fileError(path, err))
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(path); err != nil {
+				errs = append(errs, fileError(path, err))
+				return nil
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			errs = append(errs, &ArgumentError{Arg: path, Reason: "Not a regular file or directory"})
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if strings.ContainsAny(rel, "\n\r") {
+			errs = append(errs, &ArgumentError{Arg: path, Reason: "Illegal file name in directory"})
+			return nil
+		}
+		m.Entries = append(m.Entries, ManifestEntry{Path: filepath.ToSlash(rel)})
+		k := len(m.Entries) - 1
+		jobs = append(jobs, hashJob{name: path, algs: []string{h.Hash}, done: func(d []string, _ *MerkleTree, size int64) {
+			m.Entries[k].Hash, m.Entries[k].Size = d[0], size
+		}})
+		return nil
+	})
+	if err != nil {
+		return nil, fileError(dir, err)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if errs = h.hashFiles(jobs); len(errs) > 0 {
+		return nil, errs
+	}
+	m.sort()
+
+	return
+}
+
+func (m *Manifest) sort() {
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+}
+
+// Bytes returns the canonical text form of m: a line of the form "<digest> <size> <path>"
+// for each entry, sorted by path.
+func (m *Manifest) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, e := range m.Entries {
+		fmt.Fprintf(&buf, "%s %d %s\n", e.Hash, e.Size, e.Path)
+	}
+	return buf.Bytes()
+}
+
+// Digest returns the algorithm-prefixed digest of the canonical form of m.
+func (m *Manifest) Digest(alg string) (d string, err error) {
+	h, err := NewHash(alg)
+	if err != nil {
+		return
+	}
+	h.Write(m.Bytes())
+	return Digest(alg, h.Sum(nil)), nil
+}
+
+// Check reports whether m is in canonical order, has well-formed entries and has the
+// digest d.
+func (m *Manifest) Check(d string) (err error) {
+	alg, _, err := ParseDigest(d)
+	if err != nil {
+		return
+	}
+	for i, e := range m.Entries {
+		if strings.ContainsAny(e.Path, "\n\r") {
+			return errors.New(fmt.Sprintf("Illegal manifest path: %q", e.Path))
+		}
+		for _, c := range strings.Split(e.Path, "/") {
+			if c == "" || c == "." || c == ".." {
+				return errors.New(fmt.Sprintf("Illegal manifest path: %q", e.Path))
+			}
+		}
+		if i > 0 && m.Entries[i-1].Path >= e.Path {
+			return errors.New("Manifest is not in canonical order.")
+		}
+		if _, _, err = ParseDigest(e.Hash); err != nil {
+			return
+		}
+	}
+	md, err := m.Digest(alg)
+	if err != nil {
+		return
+	}
+	if !EqualDigests(md, d) {
+		return errors.New(fmt.Sprintf("Manifest digest mismatch: %s != %s", md, d))
+	}
+	return
+}
+
+// ParseManifest parses the canonical text form of a manifest.
+func ParseManifest(b []byte) (m *Manifest, err error) {
+	m = &Manifest{}
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			return nil, errors.New("Manifest truncated.")
+		}
+		f := strings.SplitN(line[:len(line)-1], " ", 3)
+		if len(f) != 3 {
+			return nil, errors.New(fmt.Sprintf("Malformed manifest line: %q", line))
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Malformed manifest line: %q", line))
+		}
+		m.Entries = append(m.Entries, ManifestEntry{Hash: f[0], Size: size, Path: f[2]})
+	}
+	return
+}
@@ -0,0 +1,149 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, contents := range map[string]string{
+		"b":     "",
+		"a/c":   "contents of c\n",
+		"a/b/d": "contents of d\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewManifest(Hasher{Hash: "sha256"}, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var paths []string
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"a/b/d", "a/c", "b"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got paths %v, want %v", paths, want)
+	}
+	if m.Entries[2].Hash != "sha256:"+emptySHA256 || m.Entries[2].Size != 0 {
+		t.Errorf("unexpected entry for empty file: %+v", m.Entries[2])
+	}
+
+	d, err := m.Digest("sha256")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = m.Check(d); err != nil {
+		t.Errorf("unexpected error checking manifest: %v", err)
+	}
+	p, err := ParseManifest(m.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error parsing manifest: %v", err)
+	}
+	if !reflect.DeepEqual(p, m) {
+		t.Errorf("round trip mismatch: got %+v, want %+v", p, m)
+	}
+	if err = p.Check(d); err != nil {
+		t.Errorf("unexpected error checking parsed manifest: %v", err)
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	entry := func(path string) ManifestEntry {
+		return ManifestEntry{Path: path, Hash: "sha256:" + emptySHA256}
+	}
+	for _, test := range []struct {
+		name    string
+		entries []ManifestEntry
+	}{
+		{name: "newline", entries: []ManifestEntry{entry("a\nb")}},
+		{name: "carriage return", entries: []ManifestEntry{entry("a\r")}},
+		{name: "empty", entries: []ManifestEntry{entry("")}},
+		{name: "absolute", entries: []ManifestEntry{entry("/a")}},
+		{name: "trailing slash", entries: []ManifestEntry{entry("a/")}},
+		{name: "dot", entries: []ManifestEntry{entry("./a")}},
+		{name: "dot dot", entries: []ManifestEntry{entry("a/../../b")}},
+		{name: "order", entries: []ManifestEntry{entry("b"), entry("a")}},
+		{name: "duplicate", entries: []ManifestEntry{entry("a"), entry("a")}},
+		{name: "digest", entries: []ManifestEntry{{Path: "a", Hash: "sha256:00"}}},
+	} {
+		m := &Manifest{Entries: test.entries}
+		d, err := m.Digest("sha256")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if err = m.Check(d); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	m := &Manifest{Entries: []ManifestEntry{entry("a"), entry("b")}}
+	d, err := (&Manifest{Entries: m.Entries[:1]}).Digest("sha256")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = m.Check(d); err == nil {
+		t.Error("expected error for digest mismatch")
+	}
+	if err = m.Check("sha256:"); err == nil {
+		t.Error("expected error for malformed digest")
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want *Manifest
+		fail bool
+	}{
+		{text: "", want: &Manifest{}},
+		{
+			text: "sha256:" + emptySHA256 + " 0 a b\n",
+			want: &Manifest{Entries: []ManifestEntry{{Path: "a b", Hash: "sha256:" + emptySHA256}}},
+		},
+		{text: "sha256:" + emptySHA256 + " 0 a", fail: true},
+		{text: "sha256:" + emptySHA256 + " 0\n", fail: true},
+		{text: "sha256:" + emptySHA256 + " x a\n", fail: true},
+		{text: "sha256:" + emptySHA256 + " -\n", fail: true},
+	} {
+		m, err := ParseManifest([]byte(test.text))
+		if (err != nil) != test.fail {
+			t.Errorf("%q: unexpected error state: %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.text, m, test.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	DefaultChunkSize = 16 << 20 // Chunk size used for Merkle trees unless otherwise specified.
+	MaxChunkSize     = 64 << 20 // Largest chunk size accepted.
+)
+
+// MerkleTree holds the digests of the fixed-size chunks of a file and the root of the
+// binary hash tree built over them. Interior nodes are the hash of 0x01 followed by
+// their children; a node without a sibling is promoted unchanged.
+type MerkleTree struct {
+	Hash      string   // Hash algorithm.
+	ChunkSize int64    // Size of all but the last chunk.
+	Root      string   // Algorithm-prefixed root digest.
+	Leaves    []string // Hex sums of each chunk.
+}
+
+// merkleWriter builds a MerkleTree from the data written to it.
+type merkleWriter struct {
+	tree *MerkleTree
+	h    hash.Hash
+	n    int64 // bytes in the current chunk
+}
+
+func newMerkleWriter(alg string, chunk int64) (w *merkleWriter, err error) {
+	if chunk <= 0 || chunk > MaxChunkSize {
+		return nil, errors.New(fmt.Sprintf("Illegal chunk size: %d", chunk))
+	}
+	h, err := NewHash(alg)
+	if err != nil {
+		return
+	}
+	return &merkleWriter{tree: &MerkleTree{Hash: alg, ChunkSize: chunk}, h: h}, nil
+}
+
+func (w *merkleWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c := b
+		if rem := w.tree.ChunkSize - w.n; int64(len(c)) > rem {
+			c = c[:rem]
+		}
+		w.h.Write(c)
+		w.n += int64(len(c))
+		n += len(c)
+		b = b[len(c):]
+		if w.n == w.tree.ChunkSize {
+			w.flush()
+		}
+	}
+	return
+}
+
+func (w *merkleWriter) flush() {
+	w.tree.Leaves = append(w.tree.Leaves, fmt.Sprintf("%x", w.h.Sum(nil)))
+	w.h.Reset()
+	w.n = 0
+}
+
+// finish completes the final chunk and returns the tree.
+func (w *merkleWriter) finish() *MerkleTree {
+	if w.n > 0 || len(w.tree.Leaves) == 0 {
+		w.flush()
+	}
+	root, _ := w.tree.root()
+	w.tree.Root = Digest(w.tree.Hash, root)
+	return w.tree
+}
+
+func (t *MerkleTree) root() (root []byte, err error) {
+	h, err := NewHash(t.Hash)
+	if err != nil {
+		return
+	}
+	level := make([][]byte, len(t.Leaves))
+	for i, l := range t.Leaves {
+		if level[i], err = hex.DecodeString(l); err != nil || len(level[i]) != h.Size() {
+			return nil, errors.New(fmt.Sprintf("Malformed chunk digest %d: %q", i, l))
+		}
+	}
+	if len(level) == 0 {
+		return nil, errors.New("Empty Merkle tree")
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+			h.Reset()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0], nil
+}
+
+// Verify checks that the leaves of t are consistent with its root and that it
+// describes a file of the given size.
+func (t *MerkleTree) Verify(size int64) (err error) {
+	if t.ChunkSize <= 0 || t.ChunkSize > MaxChunkSize {
+		return errors.New(fmt.Sprintf("Illegal chunk size: %d", t.ChunkSize))
+	}
+	if n := (size + t.ChunkSize - 1) / t.ChunkSize; int64(len(t.Leaves)) != n && !(n == 0 && len(t.Leaves) == 1) {
+		return errors.New(fmt.Sprintf("Merkle tree has %d chunks, expected %d", len(t.Leaves), n))
+	}
+	root, err := t.root()
+	if err != nil {
+		return
+	}
+	if !EqualDigests(Digest(t.Hash, root), t.Root) {
+		return errors.New(fmt.Sprintf("Merkle root mismatch: %s != %x", t.Root, root))
+	}
+	return
+}
+
+// Chunk returns the offset and length of chunk i in a file of the given size.
+func (t *MerkleTree) Chunk(i int, size int64) (off, n int64) {
+	off = int64(i) * t.ChunkSize
+	n = t.ChunkSize
+	if off+n > size {
+		n = size - off
+	}
+	return
+}
+
+// CheckChunk reports whether b holds the contents of chunk i.
+func (t *MerkleTree) CheckChunk(i int, b []byte) (ok bool, err error) {
+	if i < 0 || i >= len(t.Leaves) {
+		return false, errors.New(fmt.Sprintf("No chunk %d", i))
+	}
+	h, err := NewHash(t.Hash)
+	if err != nil {
+		return
+	}
+	h.Write(b)
+	want, err := hex.DecodeString(t.Leaves[i])
+	if err != nil {
+		return
+	}
+	return bytes.Equal(h.Sum(nil), want), nil
+}
+
+// CorruptChunks returns the indices of the chunks of the named file that do not match
+// t. Chunks missing from a short file are corrupt.
+func CorruptChunks(name string, t *MerkleTree, size int64) (bad []int, err error) {
+	if err = t.Verify(size); err != nil {
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, t.ChunkSize)
+	for i := range t.Leaves {
+		_, n := t.Chunk(i, size)
+		m, err := io.ReadFull(f, buf[:n])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		if int64(m) < n {
+			bad = append(bad, i)
+			continue
+		}
+		if ok, err := t.CheckChunk(i, buf[:n]); err != nil {
+			return nil, err
+		} else if !ok {
+			bad = append(bad, i)
+		}
+	}
+	return
+}
@@ -0,0 +1,192 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTemp writes b to a new file in a temporary directory, returning its path.
+func writeTemp(t *testing.T, b []byte) string {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCorruptChunks(t *testing.T) {
+	const chunk = 16
+	orig := bytes.Repeat([]byte("0123456789abcdef"), 5)
+	orig = append(orig, "tail"...) // 6 chunks, the last short
+
+	for _, test := range []struct {
+		name   string
+		damage func([]byte) []byte
+		bad    []int
+	}{
+		{name: "intact", damage: func(b []byte) []byte { return b }},
+		{name: "first byte", damage: func(b []byte) []byte { b[0] ^= 1; return b }, bad: []int{0}},
+		{name: "two chunks", damage: func(b []byte) []byte { b[20] ^= 1; b[70] ^= 1; return b }, bad: []int{1, 4}},
+		{name: "last chunk", damage: func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, bad: []int{5}},
+		{name: "truncated", damage: func(b []byte) []byte { return b[:40] }, bad: []int{2, 3, 4, 5}},
+		{name: "empty", damage: func(b []byte) []byte { return nil }, bad: []int{0, 1, 2, 3, 4, 5}},
+	} {
+		_, tree, size, err := HashFileTree(writeTemp(t, orig), chunk, "sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.Leaves) != 6 {
+			t.Fatalf("%s: got %d chunks, want 6", test.name, len(tree.Leaves))
+		}
+		damaged := test.damage(append([]byte(nil), orig...))
+		bad, err := CorruptChunks(writeTemp(t, damaged), tree, size)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(bad, test.bad) {
+			t.Errorf("%s: got corrupt chunks %v, want %v", test.name, bad, test.bad)
+		}
+	}
+}
+
+func TestMerkleTreeVerify(t *testing.T) {
+	b := bytes.Repeat([]byte("x"), 50)
+	_, tree, size, err := HashFileTree(writeTemp(t, b), 16, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tree.Verify(size); err != nil {
+		t.Fatalf("unexpected error verifying tree: %v", err)
+	}
+	for _, test := range []struct {
+		name   string
+		modify func(*MerkleTree)
+		size   int64
+	}{
+		{name: "wrong size", modify: func(*MerkleTree) {}, size: size + 16},
+		{name: "changed leaf", modify: func(t *MerkleTree) { t.Leaves[1] = t.Leaves[0][:63] + "0" }, size: size},
+		{name: "dropped leaf", modify: func(t *MerkleTree) { t.Leaves = t.Leaves[:3] }, size: size},
+		{name: "bad chunk size", modify: func(t *MerkleTree) { t.ChunkSize = MaxChunkSize + 1 }, size: size},
+	} {
+		c := *tree
+		c.Leaves = append([]string(nil), tree.Leaves...)
+		test.modify(&c)
+		if c.Verify(test.size) == nil {
+			t.Errorf("%s: expected error verifying tree", test.name)
+		}
+	}
+}
+
+func TestCheckChunk(t *testing.T) {
+	b := []byte("0123456789abcdef0123")
+	_, tree, _, err := HashFileTree(writeTemp(t, b), 16, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		i    int
+		b    []byte
+		ok   bool
+		fail bool
+	}{
+		{i: 0, b: b[:16], ok: true},
+		{i: 1, b: b[16:], ok: true},
+		{i: 1, b: []byte("abcd"), ok: false},
+		{i: 2, b: b[16:], fail: true},
+		{i: -1, b: b[:16], fail: true},
+	} {
+		ok, err := tree.CheckChunk(test.i, test.b)
+		if (err != nil) != test.fail {
+			t.Errorf("chunk %d: unexpected error state: %v", test.i, err)
+		}
+		if ok != test.ok {
+			t.Errorf("chunk %d: got ok=%t, want %t", test.i, ok, test.ok)
+		}
+	}
+}
+
+func TestHashCacheTree(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	b := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenHashCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, tree, _, err := c.HashFileTree(path, 16, "sha256", "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree == nil {
+		t.Fatal("no tree for file larger than chunk")
+	}
+	if err = c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the contents in place, keeping the size and modification time, so that
+	// only a cache hit returns the original digests.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 1
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = os.Chtimes(path, time.Now(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenHashCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd, ctree, _, err := c.HashFileTree(path, 16, "sha256", "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cd, d) || !reflect.DeepEqual(ctree, tree) {
+		t.Errorf("file was rehashed: got %v %v, want cached %v %v", cd, ctree, d, tree)
+	}
+
+	// A different chunk size needs a new tree.
+	_, ctree, _, err = c.HashFileTree(path, 32, "sha256", "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctree == nil || ctree.ChunkSize != 32 || ctree.Root == tree.Root {
+		t.Errorf("got tree %+v, want new tree with chunk size 32", ctree)
+	}
+}
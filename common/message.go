@@ -0,0 +1,132 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Kinds of Message sent by the server.
+const (
+	KindOK      = "ok"      // The exchange completed.
+	KindError   = "error"   // The exchange failed; Code says why.
+	KindWarning = "warning" // A problem with File that does not end the exchange.
+	KindInfo    = "info"    // Text for the user.
+	KindData    = "data"    // Data holds the reply to a step of the exchange.
+	KindStatus  = "status"  // Data holds a list of Status.
+)
+
+// Codes of error and warning messages. They are stable and may be relied on by clients.
+const (
+	CodeBadMessage   = "bad-message"  // The client sent a malformed or inconsistent message.
+	CodeIncompatible = "incompatible" // The client does not speak a common protocol version.
+	CodeUnsupported  = "unsupported"  // A hash algorithm or encoding is not accepted.
+	CodeAuth         = "auth"         // The client's identity could not be established.
+	CodeCollision    = "collision"    // A different file is stored under the same name.
+	CodeMismatch     = "mismatch"     // A file did not match its digest.
+	CodeCorrupt      = "corrupt"      // Chunks of a stored file are damaged.
+	CodeMissing      = "missing"      // A file is not on the server.
+	CodeBusy         = "busy"         // The file is being received by another exchange.
+	CodeTooLarge     = "too-large"    // A file is larger than declared.
+	CodeTransfer     = "transfer"     // The contents of a file could not be received.
+	CodeServerFault  = "server-fault" // The server failed; the client may retry.
+)
+
+// Message is the envelope of every message sent by the server over a websocket and of
+// HTTP error responses. The replies described for each exchange are sent as the Data of
+// data or status messages, failures as error messages, and a successful exchange ends
+// with an ok message.
+type Message struct {
+	Kind    string          `json:"kind"`
+	Code    string          `json:"code,omitempty"`
+	File    string          `json:"file,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// OK returns the message that ends a successful exchange.
+func OK() Message { return Message{Kind: KindOK} }
+
+// Errorf returns an error message with the given code concerning the named file, which
+// may be empty.
+func Errorf(code, file, format string, a ...interface{}) Message {
+	return Message{Kind: KindError, Code: code, File: file, Message: fmt.Sprintf(format, a...)}
+}
+
+// Warningf returns a warning message with the given code concerning the named file.
+func Warningf(code, file, format string, a ...interface{}) Message {
+	return Message{Kind: KindWarning, Code: code, File: file, Message: fmt.Sprintf(format, a...)}
+}
+
+// Infof returns an informational message concerning the named file, which may be empty.
+func Infof(file, format string, a ...interface{}) Message {
+	return Message{Kind: KindInfo, File: file, Message: fmt.Sprintf(format, a...)}
+}
+
+// NewData returns a message of the given kind holding v encoded as JSON.
+func NewData(kind string, v interface{}) (m Message, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return Message{Kind: kind, Data: b}, nil
+}
+
+// Decode decodes the data of m into v.
+func (m Message) Decode(v interface{}) error {
+	if len(m.Data) == 0 {
+		return errors.New(fmt.Sprintf("Bad message: %s message has no data.", m.Kind))
+	}
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		return errors.New(fmt.Sprintf("Bad message: malformed %s data %q: %v.", m.Kind, m.Data, err))
+	}
+	return nil
+}
+
+// Err returns the error described by m, or nil if m is not an error message.
+func (m Message) Err() error {
+	if m.Kind != KindError {
+		return nil
+	}
+	return &Error{Code: m.Code, File: m.File, Message: m.Message}
+}
+
+func (m Message) String() string { return m.Message }
+
+// Error is an error reported by the server.
+type Error struct {
+	Code    string
+	File    string
+	Message string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("Error: %s (%s)", e.Message, e.Code) }
+
+// ErrorCode returns the code of err if it is, or wraps, an Error reported by the server,
+// and the empty string otherwise.
+func ErrorCode(err error) string {
+	if p, ok := err.(*PermanentError); ok {
+		err = p.Err
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
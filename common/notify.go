@@ -18,25 +18,42 @@ along with this program.  If not, see <http:www.gnu.org/licenses/>.
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
-	"fmt"
-	"hash"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Links struct {
-	Hash    hash.Hash
+	Hash    string // Hash algorithm used for Inputs and Outputs.
 	Inputs  []Input
 	Outputs []Output
 }
 
-func NewLinks(h hash.Hash, args []string) (l *Links, err error) {
-	l = &Links{Hash: h}
+// NewLinks hashes the input and output files described by args as specified by h.
+// Up to h.Workers files are hashed concurrently; the order of Inputs and Outputs
+// follows args. Outputs that are streams are marked and left for the caller to hash
+// with a HashReader as they are sent. Problems with individual arguments or files are returned as
+// FileErrors in argument order.
+func NewLinks(h Hasher, args []string) (l *Links, err error) {
+	all := h.Algorithms()
+	for _, alg := range all {
+		if _, err = NewHash(alg); err != nil {
+			return nil, err
+		}
+	}
+	l = &Links{Hash: h.Hash}
 
-	outputList := true
+	var (
+		jobs       []hashJob
+		dirs       []int // indices of directory outputs
+		outputList = true
+		stdin      bool
+		errs       FileErrors
+	)
 	for i := range args {
 		switch args[i] {
 		case "-i":
@@ -44,40 +61,147 @@ func NewLinks(h hash.Hash, args []string) (l *Links, err error) {
 		case "-o":
 			outputList = true
 		default:
-			if args[i][0] == '-' {
-				err = errors.New(fmt.Sprintf("Illegal flag: %q\n", args[i]))
+			if args[i] == "" || (args[i][0] == '-' && !(outputList && strings.HasPrefix(args[i], "-,"))) {
+				errs = append(errs, &ArgumentError{Arg: args[i], Reason: "Illegal flag"})
+				continue
 			}
 			if outputList {
 				so := strings.Split(args[i], ",")
-				if len(so) != 2 {
-					err = errors.New(fmt.Sprintf("Bad outputfile (should be in the form <name>,<type>): %q\n", args[i]))
-					return
+				if len(so) != 2 || so[0] == "" || so[1] == "" {
+					errs = append(errs, &ArgumentError{Arg: args[i], Reason: "Bad outputfile (should be in the form <name>,<type>)"})
+					continue
 				}
-				_, n := filepath.Split(so[0])
-				h, size := HashFile(l.Hash, so[0])
+				_, n := filepath.Split(filepath.Clean(so[0]))
 				l.Outputs = append(l.Outputs, Output{
 					OriginalName: n,
 					FullPath:     so[0],
-					Hash:         h,
 					Type:         so[1],
-					Size:         &size,
 				})
+				k := len(l.Outputs) - 1
+				if IsStream(so[0]) {
+					if so[0] == "-" {
+						if stdin {
+							errs = append(errs, &ArgumentError{Arg: args[i], Reason: "Standard input can only be used once"})
+							continue
+						}
+						stdin = true
+						l.Outputs[k].OriginalName = "stdin"
+					}
+					l.Outputs[k].Stream = true
+					continue
+				}
+				if _, mode, err := Exists(so[0]); err == nil && mode.IsDir() {
+					dirs = append(dirs, k)
+					continue
+				}
+				jobs = append(jobs, hashJob{name: so[0], algs: all, chunk: h.Chunk, done: func(d []string, tree *MerkleTree, size int64) {
+					o := &l.Outputs[k]
+					o.Hash, o.Size, o.Chunks = d[0], &size, tree
+					if len(d) > 1 {
+						o.Digests = make(map[string]string)
+						for j, alg := range all[1:] {
+							o.Digests[alg] = d[j+1]
+						}
+					}
+				}})
 			} else {
 				if len(strings.Split(args[i], ",")) != 1 {
-					err = errors.New(fmt.Sprintf("Bad inputfile: %q\n", args[i]))
+					errs = append(errs, &ArgumentError{Arg: args[i], Reason: "Bad inputfile"})
+					continue
 				}
-				h, _ := HashFile(l.Hash, args[i])
-				l.Inputs = append(l.Inputs, Input{
-					Hash: h,
-				})
+				if IsStream(args[i]) {
+					errs = append(errs, &ArgumentError{Arg: args[i], Reason: "Inputs cannot be streamed"})
+					continue
+				}
+				l.Inputs = append(l.Inputs, Input{})
+				k := len(l.Inputs) - 1
+				jobs = append(jobs, hashJob{name: args[i], algs: all[:1], done: func(d []string, _ *MerkleTree, _ int64) {
+					l.Inputs[k].Hash = d[0]
+				}})
 			}
 		}
 	}
 
-	if len(l.Outputs) == 0 {
-		err = errors.New("No output files specified.")
+	if len(l.Outputs) == 0 && len(errs) == 0 {
+		errs = append(errs, &ArgumentError{Reason: "No output files specified"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	errs = h.hashFiles(jobs)
+	for _, i := range dirs {
+		o := &l.Outputs[i]
+		m, err := NewManifest(h, o.FullPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if o.Hash, err = m.Digest(h.Hash); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		size := int64(len(m.Bytes()))
+		o.Size, o.Manifest = &size, m
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return
+}
+
+// hashJob describes a file to be hashed by Hasher.hashFiles.
+type hashJob struct {
+	name  string
+	algs  []string
+	chunk int64 // Merkle tree chunk size; zero for no tree.
+
+	// done is called with the results of a successful hash.
+	done func(d []string, tree *MerkleTree, size int64)
+}
+
+// hashFiles hashes the files described by jobs with up to h.Workers concurrent hashers.
+// Calls to the jobs' done functions are serialised. Errors are returned in job order.
+func (h Hasher) hashFiles(jobs []hashJob) (errs FileErrors) {
+	workers := h.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		queue = make(chan int)
+		jerrs = make([]error, len(jobs))
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				j := jobs[i]
+				d, tree, size, err := h.Cache.HashFileTree(j.name, j.chunk, j.algs...)
+				mu.Lock()
+				if err != nil {
+					jerrs[i] = err
+				} else {
+					j.done(d, tree, size)
+				}
+				mu.Unlock()
+			}
+		}()
 	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
 
+	for _, err := range jerrs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return
 }
 
@@ -85,6 +209,14 @@ type Notification struct {
 	Username string `json:",omitempty"`
 	Serial   string `json:",omitempty"`
 
+	// Submission is an identifier chosen by the client. A notification resent with the
+	// same Submission is accepted only once.
+	Submission string `json:",omitempty"`
+
+	// ID and Accepted are assigned by the server when it accepts the notification.
+	ID       string     `json:",omitempty"`
+	Accepted *time.Time `json:",omitempty"`
+
 	ProjectAlias string `json:",omitempty"`
 	Name         string
 	Category     string
@@ -109,10 +241,17 @@ type Input struct {
 type Output struct {
 	OriginalName string
 	FullPath     string `json:"-"`
+	Stream       bool   `json:"-"` // FullPath is "-" or a named pipe; hashed while sent.
 	Hash         string
 	Type         string
 	Sent         *bool  `json:",omitempty"`
 	Size         *int64 `json:",omitempty"`
+
+	Digests  map[string]string `json:",omitempty"` // Additional digests keyed by algorithm.
+	Manifest *Manifest         `json:",omitempty"` // Contents of a directory output.
+	Chunks   *MerkleTree       `json:",omitempty"` // Chunk digests for large files.
+	Corrupt  []int             `json:",omitempty"` // Chunks of a stored copy that need to be resent.
+	Encoding string            `json:",omitempty"` // Transfer encoding agreed in /request.
 }
 
 func NewNotification(name, project, category, comment, tool, version, keyval string, runtime time.Duration, l *Links) *Notification {
@@ -140,6 +279,21 @@ func NewNotification(name, project, category, comment, tool, version, keyval str
 	}
 }
 
+// NewID returns a random identifier.
+func NewID() (id string, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Acceptance is the reply of the server to an accepted notification.
+type Acceptance struct {
+	Receipt
+	Retry bool `json:",omitempty"` // The notification had been accepted before and was not logged again.
+}
+
 func pointer(s string) *string {
 	if s != "" {
 		return &s
@@ -156,3 +310,54 @@ func (n *Notification) Marshal() (b []byte, err error) {
 
 	return
 }
+
+// Verification states reported in a Status.
+const (
+	StatusPending  = "pending"
+	StatusVerified = "verified"
+	StatusFailed   = "failed"
+	StatusUnknown  = "unknown"
+)
+
+// Status is the verification state of a stored output.
+type Status struct {
+	Hash     string
+	Name     string    `json:",omitempty"`
+	State    string    // One of the Status constants.
+	Messages []Message `json:",omitempty"`
+}
+
+// Final reports whether s will not change.
+func (s Status) Final() bool {
+	return s.State == StatusVerified || s.State == StatusFailed || s.State == StatusUnknown
+}
+
+// StatusQuery is sent to /status to ask for the verification state of stored outputs.
+// If Wait is true the server sends each change of state until all are final.
+type StatusQuery struct {
+	Hashes []string
+	Wait   bool
+}
+
+// Query is sent to /query to find stored notifications. A notification matches if it
+// matches each field that is set. Notifications imported from the logs of earlier
+// servers have no acceptance time and do not match a time range.
+type Query struct {
+	Hashes       []string   `json:",omitempty"` // Any input or output has one of Hashes.
+	User         string     `json:",omitempty"` // Username or serial of the submitter.
+	ProjectAlias string     `json:",omitempty"`
+	Category     string     `json:",omitempty"`
+	Tool         string     `json:",omitempty"`
+	Since        *time.Time `json:",omitempty"` // Accepted at or after Since.
+	Until        *time.Time `json:",omitempty"` // Accepted before Until.
+
+	Limit int    `json:",omitempty"` // Most notifications to return; the server may return fewer.
+	After string `json:",omitempty"` // Next of the previous page of results.
+}
+
+// QueryResult is a page of the notifications matching a Query, in the order they were
+// stored.
+type QueryResult struct {
+	Notifications []Notification
+	Next          string `json:",omitempty"` // After of the query for the next page; empty on the last page.
+}
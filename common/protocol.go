@@ -0,0 +1,117 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the websocket protocol spoken by this package's
+// client and server, and MinProtocolVersion the oldest version they still speak. Version 1
+// is the first to open /request and /notify exchanges with a Hello; clients before it
+// sent their request immediately and are rejected. Version 2 wraps every message sent by
+// the server in a Message, and opens every websocket endpoint with a Hello and every HTTP
+// PUT to the store with a Hello in its HelloHeader.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// Optional features of the protocol, exchanged in Hello messages so that neither side
+// uses a feature the other lacks.
+const (
+	FeatureUpload     = "upload"     // /upload exchange, with resumption.
+	FeatureCompress   = "compress"   // Transfer encodings.
+	FeatureRepair     = "repair"     // /repair of damaged chunks.
+	FeatureStatus     = "status"     // Verification states and the /status exchange.
+	FeatureIngest     = "ingest"     // Staged copies moved into the store by /ingest.
+	FeatureSubmission = "submission" // Retried notifications accepted once; answered with a signed Acceptance.
+	FeatureQuery      = "query"      // Stored notifications found by the /query exchange.
+)
+
+// Features lists the features supported by this version of the package.
+var Features = []string{FeatureUpload, FeatureCompress, FeatureRepair, FeatureStatus, FeatureIngest, FeatureSubmission, FeatureQuery}
+
+// Hello is the first message of each side of a connection to a websocket endpoint. The
+// client sends the range of protocol versions it speaks and its features. The server
+// replies with the version to be used and the features both support, or with an error
+// message if it cannot serve the client. Exchanges that use a feature are refused to
+// clients that have not agreed it.
+type Hello struct {
+	Version    int
+	MinVersion int      `json:",omitempty"`
+	Features   []string `json:",omitempty"`
+}
+
+// NewHello returns the Hello of this version of the package.
+func NewHello() Hello {
+	return Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Features: Features}
+}
+
+// Has reports whether h lists the feature f.
+func (h Hello) Has(f string) bool {
+	for _, hf := range h.Features {
+		if hf == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Agree returns the reply of a server to the client Hello h, or an error if the client
+// does not speak a protocol version in common with the server.
+func Agree(h Hello) (reply Hello, err error) {
+	if h.Version == 0 {
+		return reply, errors.New(fmt.Sprintf("client did not announce a protocol version - upgrade to a client speaking version %d", ProtocolVersion))
+	}
+	min := h.MinVersion
+	if min == 0 {
+		min = h.Version
+	}
+	reply.Version = h.Version
+	if reply.Version > ProtocolVersion {
+		reply.Version = ProtocolVersion
+	}
+	if reply.Version < min || reply.Version < MinProtocolVersion {
+		return Hello{}, errors.New(fmt.Sprintf("incompatible protocol version - client speaks %d to %d, server speaks %d to %d", min, h.Version, MinProtocolVersion, ProtocolVersion))
+	}
+	for _, f := range Features {
+		if h.Has(f) {
+			reply.Features = append(reply.Features, f)
+		}
+	}
+	return
+}
+
+// Accept checks the server's reply to a client Hello, returning an error if the server
+// chose a protocol version this package does not speak.
+func (h Hello) Accept() error {
+	if h.Version < MinProtocolVersion || h.Version > ProtocolVersion {
+		return errors.New(fmt.Sprintf("Incompatible protocol version - server chose %d, client speaks %d to %d.", h.Version, MinProtocolVersion, ProtocolVersion))
+	}
+	return nil
+}
+
+// Session names the next exchange to be run over a /session connection. After the Hello,
+// the client sends a Session before each exchange, which then proceeds as it would over
+// the endpoint of the same name without its own Hello. Exchange is one of "request",
+// "upload", "ingest", "repair", "notify", "status" or "query".
+type Session struct {
+	Exchange string
+}
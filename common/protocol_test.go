@@ -0,0 +1,61 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAgree(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		hello Hello
+		want  Hello
+		fail  bool
+	}{
+		{name: "current", hello: NewHello(), want: Hello{Version: ProtocolVersion, Features: Features}},
+		{name: "newer", hello: Hello{Version: ProtocolVersion + 3, MinVersion: ProtocolVersion - 1}, want: Hello{Version: ProtocolVersion}},
+		{name: "features", hello: Hello{Version: ProtocolVersion, Features: []string{"unknown", FeatureQuery, FeatureUpload}}, want: Hello{Version: ProtocolVersion, Features: []string{FeatureUpload, FeatureQuery}}},
+		{name: "no version", hello: Hello{}, fail: true},
+		{name: "too old", hello: Hello{Version: MinProtocolVersion - 1}, fail: true},
+		{name: "too new", hello: Hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}, fail: true},
+	} {
+		got, err := Agree(test.hello)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: unexpected error state: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+		if err == nil {
+			if err = got.Accept(); err != nil {
+				t.Errorf("%s: agreed Hello not accepted: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestHelloAccept(t *testing.T) {
+	for _, v := range []int{0, MinProtocolVersion - 1, ProtocolVersion + 1} {
+		if err := (Hello{Version: v}).Accept(); err == nil {
+			t.Errorf("expected error accepting version %d", v)
+		}
+	}
+}
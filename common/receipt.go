@@ -0,0 +1,106 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"crypto"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Receipt is the record, signed by the server, of an accepted notification. It can be
+// verified without contacting the server.
+type Receipt struct {
+	ID         string    // Assigned by the server.
+	Submission string    `json:",omitempty"` // Identifier chosen by the client.
+	Time       time.Time // When the notification was first accepted.
+	Serial     string    // Serial of the submitter's certificate.
+	Username   string    `json:",omitempty"`
+	Outputs    []string  // Hashes of the outputs.
+
+	Certificate []byte `json:",omitempty"` // DER encoded certificate of the server.
+	Signature   []byte `json:",omitempty"` // Signature of the fields above by the server.
+}
+
+// signed returns the bytes of r covered by its signature.
+func (r *Receipt) signed() ([]byte, error) {
+	c := *r
+	c.Certificate, c.Signature = nil, nil
+	return json.Marshal(c)
+}
+
+// Sign signs r with key, recording cert, the DER encoded certificate of key.
+func (r *Receipt) Sign(key crypto.Signer, cert []byte) (err error) {
+	b, err := r.signed()
+	if err != nil {
+		return
+	}
+	h := sha256.Sum256(b)
+	if r.Signature, err = key.Sign(crand.Reader, h[:], crypto.SHA256); err != nil {
+		return
+	}
+	r.Certificate = cert
+	return
+}
+
+// Verify checks the signature of r against the certificate held by r, which is returned.
+// It is for the caller to establish that the certificate is that of the server.
+func (r *Receipt) Verify() (cert *x509.Certificate, err error) {
+	if len(r.Signature) == 0 || len(r.Certificate) == 0 {
+		return nil, errors.New(fmt.Sprintf("Receipt %q is not signed.", r.ID))
+	}
+	if cert, err = x509.ParseCertificate(r.Certificate); err != nil {
+		return nil, errors.New(fmt.Sprintf("Receipt %q has a bad certificate: %v", r.ID, err))
+	}
+	var alg x509.SignatureAlgorithm
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		alg = x509.SHA256WithRSA
+	case x509.ECDSA:
+		alg = x509.ECDSAWithSHA256
+	default:
+		return nil, errors.New(fmt.Sprintf("Receipt %q is signed with an unsupported key.", r.ID))
+	}
+	b, err := r.signed()
+	if err != nil {
+		return nil, err
+	}
+	if err = cert.CheckSignature(alg, b, r.Signature); err != nil {
+		return nil, errors.New(fmt.Sprintf("Receipt %q does not verify: %v", r.ID, err))
+	}
+	return
+}
+
+// ReadReceipt reads the receipt held in the file at path.
+func ReadReceipt(path string) (r *Receipt, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	r = &Receipt{}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, errors.New(fmt.Sprintf("Malformed receipt %q: %v", path, err))
+	}
+	return
+}
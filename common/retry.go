@@ -0,0 +1,103 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// PermanentError wraps an error that retrying the failed operation cannot fix.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Permanent marks err as permanent. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PermanentError); ok {
+		return err
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err should not be retried. The file errors of this
+// package are permanent.
+func IsPermanent(err error) bool {
+	switch err.(type) {
+	case *PermanentError, *MissingError, *DirectoryError, *PermissionError, *ArgumentError:
+		return true
+	}
+	return false
+}
+
+// Backoff describes how a failing operation is retried.
+type Backoff struct {
+	Attempts int           // Maximum number of attempts; values less than one mean one.
+	Initial  time.Duration // Delay before the first retry.
+	Max      time.Duration // Largest delay between attempts; zero for no limit.
+}
+
+// Retry calls f until it succeeds, returns a permanent error or b.Attempts calls have
+// been made. The delay between attempts starts at b.Initial and doubles after each
+// failure up to b.Max, with up to half of it replaced by random jitter. If wait is not
+// nil it is called with the error and the delay before each retry. The error of the
+// final attempt is returned, unwrapped if it was marked permanent.
+func (b Backoff) Retry(f func() error, wait func(err error, d time.Duration)) (err error) {
+	return b.RetryContext(context.Background(), f, wait)
+}
+
+// RetryContext is like Retry, but stops waiting to retry and returns the error of ctx
+// if ctx is done.
+func (b Backoff) RetryContext(ctx context.Context, f func() error, wait func(err error, d time.Duration)) (err error) {
+	d := b.Initial
+	for i := 1; ; i++ {
+		if err = f(); err == nil {
+			return
+		}
+		if IsPermanent(err) || i >= b.Attempts {
+			break
+		}
+		j := d
+		if d > 1 {
+			j = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+		}
+		if wait != nil {
+			wait(err, j)
+		}
+		t := time.NewTimer(j)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if d *= 2; b.Max > 0 && d > b.Max {
+			d = b.Max
+		}
+	}
+	if p, ok := err.(*PermanentError); ok {
+		return p.Err
+	}
+	return
+}
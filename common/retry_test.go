@@ -0,0 +1,96 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	errFail := errors.New("failed")
+	for _, test := range []struct {
+		name     string
+		attempts int
+		fails    int   // Number of calls that fail before success.
+		err      error // Error of failing calls.
+		calls    int
+		want     error
+	}{
+		{name: "success", attempts: 3, fails: 0, err: errFail, calls: 1},
+		{name: "eventual success", attempts: 3, fails: 2, err: errFail, calls: 3},
+		{name: "exhausted", attempts: 3, fails: 5, err: errFail, calls: 3, want: errFail},
+		{name: "single attempt", attempts: 0, fails: 5, err: errFail, calls: 1, want: errFail},
+		{name: "permanent", attempts: 3, fails: 5, err: Permanent(errFail), calls: 1, want: errFail},
+		{name: "missing file", attempts: 3, fails: 5, err: &MissingError{Name: "f"}, calls: 1},
+	} {
+		var calls, waits int
+		err := Backoff{Attempts: test.attempts, Initial: time.Millisecond, Max: 2 * time.Millisecond}.Retry(func() error {
+			if calls++; calls <= test.fails {
+				return test.err
+			}
+			return nil
+		}, func(error, time.Duration) { waits++ })
+		if calls != test.calls {
+			t.Errorf("%s: got %d calls, want %d", test.name, calls, test.calls)
+		}
+		if waits != calls-1 {
+			t.Errorf("%s: got %d waits for %d calls", test.name, waits, calls)
+		}
+		if test.want != nil && err != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		if test.fails < test.calls && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	err := Backoff{Attempts: 5, Initial: time.Hour}.RetryContext(ctx, func() error {
+		calls++
+		return errors.New("failed")
+	}, func(error, time.Duration) { cancel() })
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	if Permanent(nil) != nil {
+		t.Error("Permanent(nil) is not nil")
+	}
+	err := errors.New("failed")
+	p := Permanent(err)
+	if !IsPermanent(p) {
+		t.Error("permanent error not reported as permanent")
+	}
+	if IsPermanent(err) {
+		t.Error("plain error reported as permanent")
+	}
+	if pp := Permanent(p); pp != p {
+		t.Errorf("permanent error wrapped twice: %v", pp)
+	}
+}
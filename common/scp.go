@@ -19,10 +19,17 @@ package common
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os/exec"
+	"strings"
 )
 
-const cmdName = "scp"
+const (
+	cmdName = "scp"
+	sshName = "ssh"
+)
 
 func SecureCopy(src, dest string) (err error) {
 	errBuff := &bytes.Buffer{}
@@ -33,9 +40,72 @@ func SecureCopy(src, dest string) (err error) {
 		cmd := exec.Command(path, "-o PasswordAuthentication=no", src, dest)
 		cmd.Stderr = errBuff
 		if err = cmd.Run(); err != nil {
-			return
+			return errors.New(fmt.Sprintf("%s: %v: %s", cmdName, err, strings.TrimSpace(errBuff.String())))
 		}
 	}
 
 	return
 }
+
+// splitTarget splits an scp target of the form user@host:path into its host and path.
+func splitTarget(dest string) (host, path string, err error) {
+	i := strings.Index(dest, ":")
+	if i < 1 {
+		return "", "", errors.New(fmt.Sprintf("Bad scp target: %q", dest))
+	}
+	return dest[:i], dest[i+1:], nil
+}
+
+// shellPath quotes p for the remote shell, leaving a leading ~user unquoted so that
+// it is expanded.
+func shellPath(p string) string {
+	var tilde string
+	if strings.HasPrefix(p, "~") {
+		i := strings.Index(p, "/")
+		if i < 0 {
+			return p
+		}
+		tilde, p = p[:i+1], p[i+1:]
+	}
+	return tilde + "'" + strings.Replace(p, "'", `'\''`, -1) + "'"
+}
+
+func secureShell(stdin io.Reader, host string, command string) (err error) {
+	errBuff := &bytes.Buffer{}
+	path, err := exec.LookPath(sshName)
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(path, "-o PasswordAuthentication=no", host, command)
+	cmd.Stdin = stdin
+	cmd.Stderr = errBuff
+	if err = cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("%s: %v: %s", sshName, err, strings.TrimSpace(errBuff.String())))
+	}
+	return
+}
+
+// SecureStream copies the contents of r to dest, an scp target, using ssh.
+func SecureStream(r io.Reader, dest string) (err error) {
+	host, path, err := splitTarget(dest)
+	if err != nil {
+		return
+	}
+	return secureShell(r, host, "cat > "+shellPath(path))
+}
+
+// SecureRename renames the remote file src to dest. Both are scp targets on the same host.
+func SecureRename(src, dest string) (err error) {
+	host, from, err := splitTarget(src)
+	if err != nil {
+		return
+	}
+	dhost, to, err := splitTarget(dest)
+	if err != nil {
+		return
+	}
+	if dhost != host {
+		return errors.New(fmt.Sprintf("Cannot rename across hosts: %q to %q", src, dest))
+	}
+	return secureShell(nil, host, "mv -f "+shellPath(from)+" "+shellPath(to))
+}
@@ -0,0 +1,266 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Backend describes a means of transferring files to the file server. It is advertised
+// by the server in the /request exchange.
+type Backend struct {
+	Name   string // One of "upload", "scp", "rsync", "local" or "http".
+	Target string `json:",omitempty"` // Destination of the backend, a prefix of store names.
+
+	// Staged is true if files copied to Target land in the server's staging area
+	// and must be moved into the store by an /ingest exchange.
+	Staged bool `json:",omitempty"`
+}
+
+// FindBackend returns the first backend in bs with the given name.
+func FindBackend(bs []Backend, name string) (b Backend, ok bool) {
+	for _, b = range bs {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Backend{}, false
+}
+
+// Transport copies local files into the file server's store.
+type Transport interface {
+	// Send stores the named local file under the store name for the digest d.
+	Send(name, d string) error
+}
+
+// EncodingTransport is implemented by Transports that can compress files in transit.
+type EncodingTransport interface {
+	Transport
+	// SendEncoded is Send with the contents compressed using the named encoding.
+	SendEncoded(name, d, enc string) error
+}
+
+// NewTransport returns a Transport for the backend b. The "upload" backend is
+// provided by the transmeta connection itself and has no Transport. Hardlinks are
+// used by a local Transport if link is true. The client is used by an HTTP Transport.
+func NewTransport(b Backend, link bool, client *http.Client) (t Transport, err error) {
+	switch b.Name {
+	case "scp":
+		return SCP{Target: b.Target}, nil
+	case "rsync":
+		return Rsync{Target: b.Target}, nil
+	case "local":
+		return Local{Dir: b.Target, Link: link}, nil
+	case "http":
+		return HTTP{URL: b.Target, Client: client}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("No transport for backend %q", b.Name))
+}
+
+// SCP copies files with scp to a target of the form user@host:path/.
+type SCP struct {
+	Target string
+}
+
+func (t SCP) Send(name, d string) (err error) {
+	sn, err := StoreName(d)
+	if err != nil {
+		return
+	}
+	return SecureCopy(name, t.Target+sn)
+}
+
+// Rsync copies files with rsync over ssh to a target of the form user@host:path/.
+// Partially transferred files are kept by the server so that a failed copy can be resumed.
+type Rsync struct {
+	Target string
+}
+
+func (t Rsync) Send(name, d string) (err error) {
+	sn, err := StoreName(d)
+	if err != nil {
+		return
+	}
+	path, err := exec.LookPath("rsync")
+	if err != nil {
+		return
+	}
+	errBuff := &bytes.Buffer{}
+	cmd := exec.Command(path, "--partial", "--times", "-e", sshName+" -o PasswordAuthentication=no", name, t.Target+sn)
+	cmd.Stderr = errBuff
+	if err = cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("rsync: %v: %s", err, strings.TrimSpace(errBuff.String())))
+	}
+	return
+}
+
+// Local copies files into a store directory on a local or shared filesystem. If Link
+// is true files are hardlinked into the store where possible.
+type Local struct {
+	Dir  string
+	Link bool
+}
+
+func (t Local) Send(name, d string) (err error) {
+	sn, err := StoreName(d)
+	if err != nil {
+		return
+	}
+	dest := filepath.Join(t.Dir, sn)
+	if t.Link {
+		if err = os.Link(name, dest); err == nil || os.IsExist(err) {
+			return nil
+		}
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return fileError(name, err)
+	}
+	defer src.Close()
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	tmp := filepath.Join(t.Dir, fmt.Sprintf(".incoming-%x", b))
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fileError(tmp, err)
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// HelloHeader is the header of an HTTP PUT that holds the client's Hello encoded as JSON,
+// so that the server can refuse incompatible clients as it does on websocket endpoints.
+const HelloHeader = "Transmeta-Hello"
+
+// SizeHeader is the header of an encoded HTTP PUT that holds the decoded size of the
+// contents. The server rejects contents that decode to more.
+const SizeHeader = "Transmeta-Size"
+
+// HTTP copies files with an HTTP PUT of the file contents to the store name below URL.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (t HTTP) Send(name, d string) (err error) {
+	return t.SendEncoded(name, d, "")
+}
+
+// SendEncoded sends the named file with the given Content-Encoding. If enc is empty
+// the file is sent as is.
+func (t HTTP) SendEncoded(name, d, enc string) (err error) {
+	sn, err := StoreName(d)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return fileError(name, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	var body io.Reader = f
+	if enc != "" {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		w, err := NewEncoder(enc, pw)
+		if err != nil {
+			return err
+		}
+		go func() {
+			_, err := io.Copy(w, f)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}()
+		body = pr
+	}
+	req, err := http.NewRequest("PUT", t.URL+sn, body)
+	if err != nil {
+		return
+	}
+	hello, err := json.Marshal(NewHello())
+	if err != nil {
+		return
+	}
+	req.Header.Set(HelloHeader, string(hello))
+	if enc == "" {
+		req.ContentLength = fi.Size()
+	} else {
+		req.Header.Set("Content-Encoding", enc)
+		req.Header.Set(SizeHeader, strconv.FormatInt(fi.Size(), 10))
+	}
+	c := t.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		var m Message
+		if json.Unmarshal(msg, &m) == nil && m.Kind == KindError {
+			err = m.Err()
+		} else {
+			err = errors.New(fmt.Sprintf("PUT %s: %s: %s", sn, resp.Status, strings.TrimSpace(string(msg))))
+		}
+		switch resp.StatusCode {
+		case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		default:
+			// Other client errors will recur however often the request is made.
+			if resp.StatusCode/100 == 4 {
+				err = Permanent(err)
+			}
+		}
+	}
+	return
+}
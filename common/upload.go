@@ -0,0 +1,51 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package common
+
+// UploadBlock is the largest binary message sent in an /upload exchange.
+const UploadBlock = 1 << 20
+
+// Upload opens an /upload exchange. The server replies with an Upload holding the
+// offset at which the client should start, and the client then sends the file contents
+// from that offset as binary messages of at most UploadBlock bytes, ending with an empty
+// message, followed by the digest of the complete contents. The server stores the
+// contents under that digest only if it matches the digest of the file it holds.
+//
+// An upload that names its expected Digest is resumable: the server keeps the partial
+// file, keyed by the digest, if the connection is lost and offers its length as the
+// offset when the upload is next attempted.
+type Upload struct {
+	Name   string // Original name of the file, for messages.
+	Hash   string // Hash algorithm of the digest that follows the contents.
+	Digest string `json:",omitempty"` // Expected digest of the contents.
+	Size   int64  `json:",omitempty"` // Expected size of the contents.
+	Offset int64  `json:",omitempty"` // Number of bytes already held by the server.
+
+	// Encoding is the transfer encoding of the binary messages. Offset and Size
+	// always count bytes of the decoded contents.
+	Encoding string `json:",omitempty"`
+}
+
+// Ingest opens an /ingest exchange, asking the server to move a file that another
+// backend has copied into its staging area into the store. The server hashes the staged
+// file and replies with the digest under which it was stored, or an error if it did not
+// match Digest, in which case the file is quarantined and must be sent again.
+type Ingest struct {
+	Name   string // Name of the file in the staging area.
+	Digest string // Expected digest of the file.
+}
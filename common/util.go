@@ -23,47 +23,53 @@ import (
 )
 
 func Exists(name string) (ok bool, mode os.FileMode, err error) {
-	f, err := os.Open(name)
+	fi, err := os.Stat(name)
 	if err != nil {
-		if pe, ok := err.(*os.PathError); !ok {
-			return false, 0, err
-		} else if pe.Err.Error() != "no such file or directory" {
-			return false, 0, err
-		} else {
+		if os.IsNotExist(err) {
 			return false, 0, nil
 		}
-	}
-	defer f.Close()
-	fi, err := f.Stat()
-	if err != nil {
-		return
+		return false, 0, fileError(name, err)
 	}
 
 	return true, fi.Mode(), nil
 }
 
-func Collision(name string, size int64) (exists, collision bool, err error) {
+// Collision reports whether a file with the digest d and the given size is stored at name.
+// The file is hashed with the algorithm declared by d, consulting the cache c if it is not
+// nil. A file changed in place with its modification time restored is not noticed by the
+// cache, so a file server checking its own store passes nil. If a file with the name is
+// stored but has the wrong size, a *CollisionError is returned.
+func Collision(c *HashCache, name, d string, size int64) (exists bool, err error) {
+	alg, _, err := ParseDigest(d)
+	if err != nil {
+		return
+	}
+
 	ok, mode, err := Exists(name)
 	if err != nil {
 		return
 	} else if !ok {
-		return false, false, nil
+		return false, nil
 	} else if mode.IsDir() {
-		return true, true, nil
+		return true, &CollisionError{Name: name, Hash: d, Size: size}
+	}
+	h, s, err := c.HashFile(name, alg)
+	if err != nil {
+		return
 	}
-	h, s := HashFile(HashFunc, name)
-	if _, name = filepath.Split(name); h == name {
+	if sn, _ := StoreName(h[0]); sn == filepath.Base(name) {
 		if s == size {
-			return true, false, nil
+			return true, nil
 		} else {
-			return true, true, nil
+			return true, &CollisionError{Name: name, Hash: d, Size: size}
 		}
 	}
-	return false, false, nil
+	return false, nil
 }
 
+// Chomp returns s without a single trailing newline.
 func Chomp(s []byte) []byte {
-	if s[len(s)-1] == '\n' {
+	if len(s) > 0 && s[len(s)-1] == '\n' {
 		return s[:len(s)-1]
 	}
 	return s
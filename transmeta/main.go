@@ -18,33 +18,44 @@ along with this program.  If not, see <http:www.gnu.org/licenses/>.
 package main
 
 import (
+	"code.google.com/p/gdacap.transmeta/client"
 	"code.google.com/p/gdacap.transmeta/common"
-	"code.google.com/p/go.net/websocket"
 
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"errors"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
-const config = ".transmeta"
-
 const (
-	never = iota
-	whenRequired
-	always
+	config    = ".transmeta"
+	cachefile = "hashcache"
 )
 
+// pendingDir is the directory below the configuration directory that holds submissions
+// whose copies or notification have not completed.
+const pendingDir = "pending"
+
+// receiptDir is the directory below the configuration directory that holds the receipts
+// of accepted submissions.
+const receiptDir = "receipts"
+
 var (
 	name     string
 	project  string
@@ -54,12 +65,27 @@ var (
 	runtime  time.Duration
 	version  string
 	slop     string
+	id       string
 
 	batch string
 	lock  string
 
-	server string
-	port   int
+	server  string
+	port    int
+	hashes  string
+	digests string
+	chunk   int64
+	jobs    int
+
+	transfers  int
+	transports string
+	compress   string
+	quiet      bool
+	retries    int
+	backoff    time.Duration
+
+	noCache    bool
+	pruneCache bool
 
 	scptarget string
 	username  string
@@ -71,6 +97,15 @@ var (
 
 	send, verify int
 	unsafe       bool
+	wait, status bool
+	resuming     bool
+	receipts     bool
+	serverCert   string
+
+	querying     bool
+	since, until string
+	limit        int
+	asJSON       bool
 
 	help bool
 )
@@ -87,6 +122,17 @@ func init() {
 		fmt.Fprintf(os.Stderr, " %s -n <name> -cat <category> -tool <tool> -v <version> -- [-i <inputfiles>... -o ] <outputfiles,type>...\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, " %s -batch <batch-file> -lock <lock-file>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, " %s -keygen -u <user>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s -prunecache\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s -status [-wait] <hash>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s resume [-wait]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s receipt [-cert <server-cert>] <receipt-file>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s query [-u <user>] [-p <project>] [-cat <category>] [-tool <tool>] [-since <time>] [-until <time>] [-limit <n>] [-json] [<hash>...]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "An output may be a directory, a named pipe, or - to read standard input.")
+		fmt.Fprintf(os.Stderr, "Submissions whose copies or notification fail are queued in %s and replayed by resume.\n", filepath.Join(confdir, pendingDir))
+		fmt.Fprintf(os.Stderr, "Receipts signed by the server are saved in %s and verified by receipt.\n", filepath.Join(confdir, receiptDir))
+		fmt.Fprintln(os.Stderr, "query lists the notifications stored by the server that match each of the given filters;")
+		fmt.Fprintln(os.Stderr, "-u matches a user name or serial and hashes match any input or output.")
 		fmt.Fprintln(os.Stderr)
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr)
@@ -99,13 +145,33 @@ func init() {
 	flag.DurationVar(&runtime, "time", 0, "Execution wall time.")
 	flag.StringVar(&version, "v", "", "Process executable version (required unless in batch mode).")
 	flag.StringVar(&slop, "kv", "", "Key=Val pair of additional data separated by space. Errors in parsing cause silent failure.")
+	flag.StringVar(&id, "id", "", "Submission ID; a submission repeated with the same ID is recorded once (chosen at random if empty).")
 	flag.StringVar(&batch, "batch", "", "Process executable version.")
 	flag.StringVar(&lock, "lock", "", "Lock to wait on.")
 	flag.StringVar(&server, "host", "localhost", "Notification and file server.")
-	flag.StringVar(&username, "u", "", "User identity (required with keygen).")
+	flag.StringVar(&username, "u", "", "User identity (required with keygen), or the user name or serial to find with query.")
 	flag.IntVar(&port, "port", 9001, "Over 9000.")
+	flag.StringVar(&hashes, "hash", strings.Join(client.DefaultHashes, ","), "Comma separated hash algorithms in order of preference.")
+	flag.StringVar(&digests, "digests", "", "Comma separated additional hash algorithms to record for outputs, e.g. md5,sha256.")
+	flag.Int64Var(&chunk, "chunk", common.DefaultChunkSize, "Chunk size in bytes for resending damaged parts of large outputs (0 to disable).")
+	flag.IntVar(&jobs, "j", 4, "Number of files to hash concurrently.")
+	flag.IntVar(&transfers, "transfers", 2, "Number of files to send concurrently.")
+	flag.IntVar(&retries, "retries", client.DefaultRetry.Attempts, "Number of attempts to copy each file before reporting it as failed.")
+	flag.DurationVar(&backoff, "backoff", client.DefaultRetry.Initial, "Delay before retrying a failed copy; doubled after each further failure.")
+	flag.BoolVar(&quiet, "quiet", false, "Do not report transfer progress.")
+	flag.BoolVar(&noCache, "nocache", false, "Do not use cached file hashes.")
+	flag.BoolVar(&pruneCache, "prunecache", false, "Remove stale entries from the hash cache.")
 	flag.IntVar(&send, "send", 1, "When to send: 0 - never, 1 - if not on server, 2 - always.")
 	flag.IntVar(&verify, "verify", 1, "When to verify: 0 - never, 1 - if sent successfully, 2 - always.")
+	flag.StringVar(&compress, "compress", strings.Join(common.Encodings, ","), "Comma separated transfer encodings to offer for compressible files; empty to disable.")
+	flag.StringVar(&transports, "transport", strings.Join(client.DefaultTransports, ","), "Comma separated transfer backends in order of preference: upload, http, rsync, scp, local or link.")
+	flag.BoolVar(&wait, "wait", false, "Wait for the server to verify sent outputs.")
+	flag.BoolVar(&status, "status", false, "Report the server verification state of the outputs with the hashes given as arguments.")
+	flag.StringVar(&serverCert, "cert", "", "PEM file holding the server certificate that receipts must be signed with.")
+	flag.StringVar(&since, "since", "", "Find notifications accepted at or after this time, as 2006-01-02 or RFC 3339.")
+	flag.StringVar(&until, "until", "", "Find notifications accepted before this time, as 2006-01-02 or RFC 3339.")
+	flag.IntVar(&limit, "limit", 0, "Most notifications to find (0 for all).")
+	flag.BoolVar(&asJSON, "json", false, "Print the notifications found as JSON.")
 	flag.BoolVar(&unsafe, "unsafe", true, "Allow connection to message server without CA.")
 	flag.BoolVar(&force, "f", false, "Force overwrite of files.")
 	flag.BoolVar(&keygen, "keygen", false, "Generate a key pair for the specified user.")
@@ -127,19 +193,12 @@ func requiredFlags() (err error) {
 		failed = append(failed, "v")
 	}
 	if len(failed) > 0 {
-		fmt.Fprintf(os.Stderr, "Missing required flags: %s.\n", strings.Join(failed, ", "))
-		flag.Usage()
-		os.Exit(1)
+		return fmt.Errorf("Missing required flags: %s.", strings.Join(failed, ", "))
 	}
-	failed = failed[:0]
-	if send < never || send > always {
-		fmt.Println(send, never, always, whenRequired)
-		fmt.Println(send < never, send > always, send == whenRequired)
+	if p := client.Policy(send); p < client.Never || p > client.Always {
 		failed = append(failed, fmt.Sprintf(" 'send': %v.", send))
 	}
-	if verify < never || verify > always {
-		fmt.Println(verify, never, always)
-		fmt.Println(verify < never, verify > always)
+	if p := client.Policy(verify); p < client.Never || p > client.Always {
 		failed = append(failed, fmt.Sprintf(" 'verify': %v.", verify))
 	}
 	if len(failed) > 0 {
@@ -149,100 +208,160 @@ func requiredFlags() (err error) {
 	return
 }
 
-func Send(send int, l *common.Links, config *websocket.Config) (ins []string, err error) {
-	var scptarget string
-	if send != never {
-		config.Location, err = url.ParseRequestURI(fmt.Sprintf("wss://%s:%d/request", server, port))
-		if err != nil {
-			log.Fatal(err)
+// submission returns the submission described by the notification flags.
+func submission() client.Submission {
+	return client.Submission{
+		Name:     name,
+		Project:  project,
+		Category: category,
+		Comment:  comment,
+		Tool:     tool,
+		Version:  version,
+		Slop:     slop,
+		Runtime:  runtime,
+		ID:       id,
+	}
+}
+
+// logError logs err, giving each file error its own line, and reports whether
+// any of the errors was caused by a malformed argument.
+func logError(err error) (badArg bool) {
+	fe, ok := err.(common.FileErrors)
+	if !ok {
+		log.Print(err)
+		return false
+	}
+	for _, e := range fe {
+		if _, ok := e.(*common.ArgumentError); ok {
+			badArg = true
 		}
-		var ws *websocket.Conn
-		ws, err = websocket.DialConfig(config)
+		log.Print(e)
+	}
+	return
+}
+
+// verifyReceipts verifies the signature of each of the receipts in files, printing
+// those that verify, and reports whether all did. If certFile is not empty, receipts
+// must be signed with the certificate it holds.
+func verifyReceipts(files []string, certFile string) (ok bool) {
+	var want []byte
+	if certFile != "" {
+		b, err := ioutil.ReadFile(certFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := websocket.JSON.Send(ws, l.Outputs); err != nil {
-			log.Fatal(err)
-		}
-		var m string
-		if err = websocket.Message.Receive(ws, &m); err != nil {
-			log.Fatal(err)
-		} else if m == "Thankyou." {
-			goto bye
-		} else if m[:5] == "Error" {
-			log.Fatal(m)
-		} else {
-			if err = json.Unmarshal([]byte(m), &l.Outputs); err != nil {
-				err = errors.New(fmt.Sprintf("Bad message: malformed JSON %q: %v.", m, err))
-				return
-			}
-		}
-
-		if err := websocket.Message.Receive(ws, &scptarget); err != nil {
-			log.Fatal(err)
+		block, _ := pem.Decode(b)
+		if block == nil || block.Type != "CERTIFICATE" {
+			log.Fatalf("No certificate in %q.", certFile)
 		}
-	}
-bye:
-	if scptarget == "" && send > never {
-		err = errors.New("Could not get file server identity.")
+		want = block.Bytes
 	}
 
-	for i, o := range l.Outputs {
-		if o.Sent == nil {
-			if send > never {
-				log.Println("File collision. Refusing to send. Please de-collision and try again.")
-			}
-			if verify == always {
-				l.Outputs[i].Sent = new(bool)
-				*l.Outputs[i].Sent = true
-			}
-			continue
-		}
-		if send == always || (!*o.Sent && send > never) {
-			log.Printf("Copying %q to file server...", o.OriginalName)
-			if err := common.SecureCopy(o.FullPath, scptarget+o.Hash); err != nil {
-				log.Printf("Copy %q failed.", o.OriginalName)
-				ins = append(ins, fmt.Sprintf(" scp %s %s%s", o.FullPath, scptarget, o.Hash))
-				*l.Outputs[i].Sent = verify == always
-			} else {
-				log.Printf("Copy %q ok.", o.OriginalName)
-				*l.Outputs[i].Sent = true && verify != never
+	ok = true
+	for _, f := range files {
+		r, err := common.ReadReceipt(f)
+		if err == nil {
+			var cert *x509.Certificate
+			if cert, err = r.Verify(); err == nil {
+				if want != nil && !bytes.Equal(cert.Raw, want) {
+					err = fmt.Errorf("Receipt %q is not signed by the certificate in %q.", r.ID, certFile)
+				} else {
+					fmt.Printf("%s: receipt %s verified.\n", f, r.ID)
+					fmt.Printf(" Signed by:   %s (serial %v, sha256 fingerprint %x)\n", cert.Subject.CommonName, cert.SerialNumber, sha256.Sum256(cert.Raw))
+					fmt.Printf(" Accepted:    %s\n", r.Time.Format(time.RFC3339))
+					fmt.Printf(" Submitter:   %s %s\n", r.Serial, r.Username)
+					if r.Submission != "" {
+						fmt.Printf(" Submission:  %s\n", r.Submission)
+					}
+					for _, h := range r.Outputs {
+						fmt.Printf(" Output:      %s\n", h)
+					}
+				}
 			}
-		} else {
-			*l.Outputs[i].Sent = verify == always
 		}
+		if err != nil {
+			log.Printf("%s: %v", f, err)
+			ok = false
+		}
+	}
+	if certFile == "" && len(files) > 0 {
+		log.Println("Check that the signing certificate is that of the server, or give it with -cert.")
 	}
 
 	return
 }
 
-func Notify(name, project, category, comment, tool, version, slop string, runtime time.Duration, l *common.Links, config *websocket.Config) (err error) {
-	n := common.NewNotification(name, project, category, comment, tool, version, slop, runtime, l)
-	config.Location, err = url.ParseRequestURI(fmt.Sprintf("wss://%s:%d/notify", server, port))
-	if err != nil {
-		return
+// parseTime parses t as a date or an RFC 3339 time, returning nil if t is empty.
+func parseTime(t string) (*time.Time, error) {
+	if t == "" {
+		return nil, nil
 	}
-	var ws *websocket.Conn
-	ws, err = websocket.DialConfig(config)
+	pt, err := time.Parse(time.RFC3339, t)
 	if err != nil {
+		if pt, err = time.ParseInLocation("2006-01-02", t, time.Local); err != nil {
+			return nil, fmt.Errorf("Bad time %q: should be 2006-01-02 or RFC 3339.", t)
+		}
+	}
+	return &pt, nil
+}
+
+// query prints the notifications stored by the server that match the query flags, as a
+// table or as JSON.
+func query(ctx context.Context, c *client.Client) (err error) {
+	q := common.Query{
+		Hashes:       flag.Args(),
+		User:         username,
+		ProjectAlias: project,
+		Category:     category,
+		Tool:         tool,
+	}
+	if q.Since, err = parseTime(since); err != nil {
 		return
 	}
-	if err = websocket.JSON.Send(ws, n); err != nil {
+	if q.Until, err = parseTime(until); err != nil {
 		return
 	}
-	var m string
+
+	var notes []common.Notification
 	for {
-		if err = websocket.Message.Receive(ws, &m); err != nil {
-			return
-		} else {
-			log.Println(m)
-			if m == "Thankyou." {
-				break
-			}
+		if limit > 0 {
+			q.Limit = limit - len(notes)
 		}
+		r, err := c.Query(ctx, q)
+		if err != nil {
+			return err
+		}
+		notes = append(notes, r.Notifications...)
+		if r.Next == "" || (limit > 0 && len(notes) >= limit) {
+			break
+		}
+		q.After = r.Next
 	}
+	c.Close()
 
-	return
+	if asJSON {
+		b, err := json.MarshalIndent(notes, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAccepted\tUser\tSerial\tProject\tCategory\tTool\tName\tOutputs")
+	for _, n := range notes {
+		accepted := "-"
+		if n.Accepted != nil {
+			accepted = n.Accepted.Local().Format("2006-01-02 15:04:05")
+		}
+		var outputs []string
+		for _, o := range n.Output {
+			outputs = append(outputs, o.OriginalName)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s %s\t%s\t%s\n",
+			n.ID, accepted, n.Username, n.Serial, n.ProjectAlias, n.Category, n.Tool.Name, n.Tool.Version, n.Name, strings.Join(outputs, ","))
+	}
+	return w.Flush()
 }
 
 func parse(line []byte) (fields []string, err error) {
@@ -296,6 +415,19 @@ func parse(line []byte) (fields []string, err error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "resume":
+			resuming = true
+		case "receipt":
+			receipts = true
+		case "query":
+			querying = true
+		}
+		if resuming || receipts || querying {
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
 	flag.Parse()
 
 	if help {
@@ -317,6 +449,28 @@ func main() {
 		os.Exit(0)
 	}
 
+	if pruneCache {
+		c, err := common.OpenHashCache(filepath.Join(confdir, cachefile))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		n := c.Prune()
+		if err = c.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Removed %d stale hash cache entries.\n", n)
+		os.Exit(0)
+	}
+
+	if receipts {
+		if !verifyReceipts(flag.Args(), serverCert) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if batch != "" {
 		if lock != "" {
 			if exists, _, err := common.Exists(lock); err != nil {
@@ -325,7 +479,7 @@ func main() {
 				log.Fatalf("Lock file %q specified, but does not exist.", lock)
 			}
 		}
-	} else {
+	} else if !status && !resuming && !querying {
 		err := requiredFlags()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -336,11 +490,19 @@ func main() {
 		lock = ""
 	}
 
-	origin := "http://localhost/"
-	config, err := websocket.NewConfig(origin, origin)
-	if err != nil {
-		log.Fatal(err)
+	hashList := strings.Split(hashes, ",")
+	var digestList []string
+	if digests != "" {
+		digestList = strings.Split(digests, ",")
 	}
+	for _, h := range append(hashList, digestList...) {
+		if _, err := common.NewHash(h); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
 	cert, err := tls.LoadX509KeyPair(
 		filepath.Join(confdir, common.Pubkey),
 		filepath.Join(confdir, common.Privkey))
@@ -348,27 +510,115 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Could not read certs files from %q: %v", confdir, err)
 		os.Exit(1)
 	}
-	config.TlsConfig = &tls.Config{
+	tlsConfig := &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: unsafe,
 	}
-	config.TlsConfig.BuildNameToCertificate()
+	tlsConfig.BuildNameToCertificate()
+
+	c := client.New(server, port, tlsConfig)
+	c.Hashes, c.Digests = hashList, digestList
+	c.Chunk, c.Jobs = chunk, jobs
+	c.SendPolicy, c.VerifyPolicy = client.Policy(send), client.Policy(verify)
+	c.Transfers = transfers
+	c.Transports = strings.Split(transports, ",")
+	c.Encodings = nil
+	if compress != "" {
+		c.Encodings = strings.Split(compress, ",")
+	}
+	c.Retry = common.Backoff{Attempts: retries, Initial: backoff, Max: client.DefaultRetry.Max}
+	c.PendingDir = filepath.Join(confdir, pendingDir)
+	c.ReceiptDir = filepath.Join(confdir, receiptDir)
+	c.Log = log.New(os.Stderr, "", log.LstdFlags)
+
+	// An interrupt stops the run, leaving interrupted uploads to be resumed; a
+	// second interrupt kills it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		log.Println("Interrupted.")
+		cancel()
+	}()
+
+	if status {
+		states, err := c.Status(ctx, flag.Args(), wait)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			fmt.Printf("%s\t%s\t%s\n", s.Hash, s.State, s.Name)
+		}
+		os.Exit(0)
+	}
+
+	if querying {
+		if err = query(ctx, c); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	prog := client.NewProgress(os.Stderr, quiet)
+	log.SetOutput(prog)
+	c.Progress, c.Log = prog, log.New(prog, "", log.LstdFlags)
+
+	if !noCache {
+		c.Cache, err = common.OpenHashCache(filepath.Join(confdir, cachefile))
+		if err != nil {
+			log.Printf("Not using hash cache: %v", err)
+		}
+	}
+	saveCache := func() {
+		if err := c.Cache.Save(); err != nil {
+			log.Printf("Could not save hash cache: %v", err)
+		}
+	}
+	defer saveCache()
+	// exit exits without losing the hashes computed before a failure.
+	exit := func(code int) {
+		saveCache()
+		os.Exit(code)
+	}
 
 	if lock != "" {
 		if err := common.Wait(lock); err != nil {
-			log.Fatalf("Locking error: %v", err)
+			log.Printf("Locking error: %v", err)
+			exit(1)
 		}
 	}
 
-	var instruct []string
+	var (
+		failed  []client.Failure
+		pending []string
+		queued  bool
+	)
+	// record notes the outcome of a submission for the end of the run.
+	record := func(r *client.Result) {
+		failed = append(failed, r.Failed...)
+		pending = append(pending, r.Pending...)
+		queued = queued || r.Queued != ""
+	}
 
-	if batch != "" {
+	if resuming {
+		results, err := c.Resume(ctx)
+		for _, r := range results {
+			record(r)
+		}
+		if err != nil {
+			log.Print(err)
+			exit(1)
+		}
+	} else if batch != "" {
 
 		f, err := os.Open(batch)
 		if err != nil {
 			log.Println(err)
 			flag.Usage()
-			os.Exit(1)
+			exit(1)
 		}
 		r := bufio.NewReader(f)
 
@@ -376,9 +626,10 @@ func main() {
 		for {
 			buff, isPrefix, err := r.ReadLine()
 			if err != nil && err != io.EOF {
-				log.Fatal(err)
+				log.Print(err)
+				exit(1)
 			}
-			if err == io.EOF {
+			if err == io.EOF || ctx.Err() != nil {
 				break
 			}
 			if isPrefix {
@@ -397,6 +648,7 @@ func main() {
 			bf.DurationVar(&runtime, "time", 0, "")
 			bf.StringVar(&version, "v", "", "")
 			bf.StringVar(&slop, "kv", "", "")
+			bf.StringVar(&id, "id", "", "")
 
 			log.Printf("Read line: %q", line)
 
@@ -424,50 +676,53 @@ func main() {
 				continue
 			}
 
-			l, err := common.NewLinks(common.HashFunc, bf.Args())
+			res, err := c.Submit(ctx, submission(), bf.Args())
 			if err != nil {
-				log.Print(err)
-				line = line[:0]
-				continue
+				logError(err)
 			}
-			ins, err := Send(send, l, config)
-			if err != nil {
-				log.Print(err)
+			if res == nil {
 				line = line[:0]
 				continue
 			}
-			instruct = append(instruct, ins...)
-
-			err = Notify(name, project, category, comment, tool, version, slop, runtime, l, config)
-			if err != nil {
-				log.Print(err)
-				line = line[:0]
-				continue
+			record(res)
+			if wait && len(res.Pending) > 0 {
+				if _, err = c.Status(ctx, res.Pending, true); err != nil {
+					log.Print(err)
+				}
 			}
 		}
 	} else {
-		l, err := common.NewLinks(common.HashFunc, flag.Args())
-		if err != nil {
-			log.Println(err)
-			flag.Usage()
-			os.Exit(1)
+		r, err := c.Submit(ctx, submission(), flag.Args())
+		if r == nil {
+			if logError(err) {
+				flag.Usage()
+			}
+			exit(1)
 		}
-		ins, err := Send(send, l, config)
+		record(r)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			exit(1)
 		}
-		instruct = append(instruct, ins...)
-
-		err = Notify(name, project, category, comment, tool, version, slop, runtime, l, config)
-		if err != nil {
-			log.Fatal(err)
+	}
+	if wait && (resuming || batch == "") && len(pending) > 0 {
+		if _, err = c.Status(ctx, pending, true); err != nil {
+			log.Print(err)
+			exit(1)
 		}
 	}
 
-	if len(instruct) > 0 {
-		log.Println("Some copies failed. Complete the transfer by executing the following commands:")
-		for _, s := range instruct {
-			log.Println(s)
+	c.Close()
+	prog.Close()
+	prog.Summary(os.Stderr)
+
+	if queued {
+		log.Printf("Run %q to retry queued submissions.", os.Args[0]+" resume")
+	}
+	if len(failed) > 0 {
+		log.Println("Some copies failed permanently or after all retries:")
+		for _, f := range failed {
+			log.Println(" " + f.String())
 		}
 	}
 }
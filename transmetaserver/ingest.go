@@ -0,0 +1,238 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Files are received into the staging directory of the store and renamed into the store
+// only once they have been verified, so that a file under a store name is always complete
+// and matches its digest. Files that do not verify are moved to the quarantine directory
+// with a report. The server's own temporary files are kept in the work directory, which
+// clients cannot name.
+//
+// Clients using the local backend copy or link files into the staging directory as
+// themselves, so if it is offered the staging directory is made world writable with the
+// sticky bit set, as for /tmp. Otherwise it is writable only by the server user, which
+// must then be the user that rsync and scp clients log in as.
+const (
+	stagingDir    = ".staging"
+	quarantineDir = ".quarantine"
+	workDir       = ".work"
+)
+
+// Quarantine is the report written beside a quarantined file.
+type Quarantine struct {
+	Name     string    // Name the client gave the file.
+	Source   string    // Client that sent the file.
+	Expected string    // Digest the file was sent as.
+	Got      string    // Digest of the file received.
+	Size     int64     // Size of the file received.
+	Time     time.Time // Time of quarantine.
+}
+
+// staging returns the path of the named file in the staging directory.
+func staging(name string) string { return filepath.Join(targetdir, stagingDir, name) }
+
+// work returns the path of the named file in the work directory.
+func work(name string) string { return filepath.Join(targetdir, workDir, name) }
+
+// makeStore creates the staging, quarantine and work directories of the store.
+func makeStore() (err error) {
+	perms := map[string]os.FileMode{stagingDir: 0755, quarantineDir: 0755, workDir: 0700}
+	for _, b := range backends {
+		if b == "local" {
+			perms[stagingDir] = 0777 | os.ModeSticky
+		}
+	}
+	for d, perm := range perms {
+		d = filepath.Join(targetdir, d)
+		if err = os.MkdirAll(d, perm); err != nil {
+			return
+		}
+		if err = os.Chmod(d, perm); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// claim returns the path of a file holding the contents of the staged file at path that
+// only the server can change. A staged file that is owned by another user or has other
+// links, such as a file linked into the staging directory by a local client, is copied
+// to the work directory and the staged file is removed, so that the stored file neither
+// changes nor changes the client's file.
+func claim(path string) (claimed string, err error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errors.New(fmt.Sprintf("%q is not a regular file", filepath.Base(path)))
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 && int(st.Uid) == os.Getuid() {
+		return path, nil
+	}
+
+	dst, err := ioutil.TempFile(filepath.Join(targetdir, workDir), ".incoming-")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(dst, f)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return
+	}
+	os.Remove(path)
+	return dst.Name(), nil
+}
+
+// peer returns a description of the client making the request r.
+func peer(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		return fmt.Sprintf("%s (%s) at %s", cert.Subject.CommonName, cert.SerialNumber, r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
+// commit moves the verified staged file at path into the store under the digest d.
+func commit(path, d string) (err error) {
+	sn, err := common.StoreName(d)
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(path, 0644); err != nil {
+		return
+	}
+	return os.Rename(path, filepath.Join(targetdir, sn))
+}
+
+// quarantine moves the staged file at path, described by q, to the quarantine directory
+// and writes q beside it.
+func quarantine(path string, q Quarantine) (err error) {
+	sn, err := common.StoreName(q.Expected)
+	if err != nil {
+		sn = "unknown"
+	}
+	q.Time = time.Now()
+	dst := filepath.Join(targetdir, quarantineDir, fmt.Sprintf("%s-%s", sn, q.Time.Format("20060102T150405.000000000")))
+	if err = os.Rename(path, dst); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(q, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(dst+".json", append(b, '\n'), 0644); err != nil {
+		return
+	}
+	log.Printf("Quarantined %q from %s as %q: %s != %s.", q.Name, q.Source, dst, q.Got, q.Expected)
+	return
+}
+
+// IngestServer verifies a file that has been copied into the staging directory by scp,
+// rsync or a local copy and moves it into the store, or quarantines it if it does not
+// match the digest it was sent as.
+func IngestServer(ws *websocket.Conn) {
+	var (
+		m    string
+		in   common.Ingest
+		alg  string
+		path string
+		d    []string
+		size int64
+		err  error
+	)
+
+	if err = websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err = json.Unmarshal([]byte(m), &in); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+	if in.Name == "" || in.Name != filepath.Base(in.Name) || in.Name == "." || in.Name == ".." {
+		reply(ws, common.Errorf(common.CodeBadMessage, in.Name, "%q is not a staged file name", in.Name))
+		goto bye
+	}
+	if alg, _, err = common.ParseDigest(in.Digest); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, in.Name, "%v", err))
+		goto bye
+	}
+	if _, ok := common.Negotiate([]string{alg}, hashes); !ok {
+		reply(ws, common.Errorf(common.CodeUnsupported, in.Name, "%q hash algorithm %q not accepted", in.Name, alg))
+		goto bye
+	}
+
+	if path, err = claim(staging(in.Name)); err != nil {
+		reply(ws, common.Errorf(common.CodeMissing, in.Name, "cannot ingest %q: %v.", in.Name, err))
+		log.Printf("Ingest of %q failed: %v", in.Name, err)
+		goto bye
+	}
+	if d, size, err = common.HashFile(path, alg); err != nil {
+		reply(ws, common.Errorf(common.CodeMissing, in.Name, "cannot ingest %q: %v.", in.Name, err))
+		log.Printf("Ingest of %q failed: %v", in.Name, err)
+		goto bye
+	}
+	if !common.EqualDigests(d[0], in.Digest) {
+		if err = quarantine(path, Quarantine{Name: in.Name, Source: peer(ws.Request()), Expected: in.Digest, Got: d[0], Size: size}); err != nil {
+			log.Printf("Server fault: %v", err)
+			os.Remove(path)
+		}
+		reply(ws, common.Errorf(common.CodeMismatch, in.Name, "%q did not verify correctly and must be resent: %s != %s.", in.Name, d[0], in.Digest))
+		goto bye
+	}
+	if err = commit(path, d[0]); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, in.Name, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	log.Printf("Ingested %q (%d bytes).", in.Name, size)
+	replyData(ws, common.KindData, d[0])
+
+bye:
+	reply(ws, common.OK())
+}
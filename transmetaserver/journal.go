@@ -0,0 +1,465 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// noteStore is a durable store of accepted notifications.
+type noteStore interface {
+	// accept stores the notification n unless a notification with the same submitter
+	// serial and submission identifier is held already. f is called with the receipt of
+	// n, holding the identifier and time assigned to it, to complete and sign it; it
+	// must not block. The first acceptance of the notification is returned, with Retry
+	// set if it was not accepted now. n is durable when accept returns without error.
+	accept(n *common.Notification, f func(r *common.Receipt) error) (common.Acceptance, error)
+
+	// add stores the notification n, which was logged by an earlier version of the
+	// server, with its receipt r if it has one, unless it is held already, and reports
+	// whether it was stored.
+	add(n *common.Notification, r *common.Receipt) (bool, error)
+
+	// find returns up to limit of the notifications matching q in the order they were
+	// stored.
+	find(q common.Query, limit int) (common.QueryResult, error)
+
+	close() error
+}
+
+// record is an entry of the journal.
+type record struct {
+	Notification *common.Notification
+	Receipt      *common.Receipt `json:",omitempty"` // nil for notifications imported without one
+}
+
+// indexEntry locates a record in the journal and summarises it.
+type indexEntry struct {
+	ID     string
+	Offset int64
+	Length int64
+
+	Submission   string     `json:",omitempty"`
+	Serial       string     `json:",omitempty"`
+	Username     string     `json:",omitempty"`
+	ProjectAlias string     `json:",omitempty"`
+	Category     string     `json:",omitempty"`
+	Tool         string     `json:",omitempty"`
+	Accepted     *time.Time `json:",omitempty"`
+	Hashes       []string   `json:",omitempty"`
+}
+
+func newIndexEntry(n *common.Notification, offset, length int64) indexEntry {
+	e := indexEntry{
+		ID:           n.ID,
+		Offset:       offset,
+		Length:       length,
+		Submission:   n.Submission,
+		Serial:       n.Serial,
+		Username:     n.Username,
+		ProjectAlias: n.ProjectAlias,
+		Category:     n.Category,
+		Tool:         n.Tool.Name,
+		Accepted:     n.Accepted,
+	}
+	for _, in := range n.Input {
+		e.Hashes = append(e.Hashes, in.Hash)
+	}
+	for _, out := range n.Output {
+		e.Hashes = append(e.Hashes, out.Hash)
+	}
+	return e
+}
+
+const (
+	journalFile = "journal"
+	indexFile   = "index"
+)
+
+// journal is a noteStore keeping records as JSON lines appended to a journal file, and
+// an index of the journal in a second file. Both are synced to disk after each record
+// is appended. The journal is authoritative: records missing from the index, as after
+// a crash, are indexed again when the journal is opened.
+type journal struct {
+	mu      sync.Mutex
+	data    *os.File
+	size    int64 // end of the last complete record
+	index   *os.File
+	isize   int64
+	entries []indexEntry
+	ids     map[string]int // entries by ID
+	subs    map[string]int // entries by submitter serial and submission identifier
+}
+
+// openJournal opens the journal held in dir, creating it if necessary. A final record
+// cut short by a crash is discarded. A complete record that cannot be decoded is an
+// error, so that the journal is repaired before records are appended after it.
+func openJournal(dir string) (j *journal, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	j = &journal{ids: make(map[string]int), subs: make(map[string]int)}
+	if j.data, err = os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	if j.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		j.data.Close()
+		return nil, err
+	}
+	if err = j.load(); err != nil {
+		j.close()
+		return nil, err
+	}
+	return
+}
+
+// load reads the index, checks it against the journal and indexes any records that
+// follow the last indexed record. Only a final record without its terminating newline
+// is truncated.
+func (j *journal) load() (err error) {
+	fi, err := j.data.Stat()
+	if err != nil {
+		return
+	}
+	dsize := fi.Size()
+
+	r := bufio.NewReader(j.index)
+	for {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var e indexEntry
+		if json.Unmarshal(b, &e) != nil || e.Offset != j.size || e.Offset+e.Length > dsize {
+			break
+		}
+		j.insert(e)
+		j.size += e.Length
+		j.isize += int64(len(b))
+	}
+	if err = j.index.Truncate(j.isize); err != nil {
+		return
+	}
+
+	if _, err = j.data.Seek(j.size, 0); err != nil {
+		return
+	}
+	var n int
+	r = bufio.NewReader(j.data)
+	for {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var rec record
+		if err = json.Unmarshal(b, &rec); err == nil && rec.Notification == nil {
+			err = errors.New("no notification")
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Corrupt journal record at offset %d of %s: %v", j.size, j.data.Name(), err))
+		}
+		if err = j.appendIndex(newIndexEntry(rec.Notification, j.size, int64(len(b)))); err != nil {
+			return err
+		}
+		j.size += int64(len(b))
+		n++
+	}
+	if n > 0 {
+		log.Printf("Indexed %d journal records.", n)
+	}
+	if j.size < dsize {
+		log.Printf("Discarding %d bytes of incomplete journal record.", dsize-j.size)
+		if err = j.data.Truncate(j.size); err != nil {
+			return
+		}
+	}
+	if err = j.data.Sync(); err != nil {
+		return
+	}
+	return j.index.Sync()
+}
+
+// matches reports whether the notification summarised by e matches q.
+func (e indexEntry) matches(q common.Query) bool {
+	switch {
+	case q.User != "" && q.User != e.Username && q.User != e.Serial,
+		q.ProjectAlias != "" && q.ProjectAlias != e.ProjectAlias,
+		q.Category != "" && q.Category != e.Category,
+		q.Tool != "" && q.Tool != e.Tool:
+		return false
+	}
+	if q.Since != nil || q.Until != nil {
+		if e.Accepted == nil ||
+			q.Since != nil && e.Accepted.Before(*q.Since) ||
+			q.Until != nil && !e.Accepted.Before(*q.Until) {
+			return false
+		}
+	}
+	if len(q.Hashes) == 0 {
+		return true
+	}
+	for _, h := range q.Hashes {
+		for _, eh := range e.Hashes {
+			if common.EqualDigests(h, eh) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (j *journal) insert(e indexEntry) {
+	j.entries = append(j.entries, e)
+	j.ids[e.ID] = len(j.entries) - 1
+	// Retries are answered from the first record of a submission.
+	if k := e.Serial + "/" + e.Submission; e.Submission != "" {
+		if _, ok := j.subs[k]; !ok {
+			j.subs[k] = len(j.entries) - 1
+		}
+	}
+}
+
+// appendIndex writes e to the index and adds it to the entries of j. The index is not
+// synced.
+func (j *journal) appendIndex(e indexEntry) (err error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	if _, err = j.index.Write(b); err != nil {
+		j.index.Truncate(j.isize)
+		return
+	}
+	j.isize += int64(len(b))
+	j.insert(e)
+	return
+}
+
+// read returns the record located by e.
+func (j *journal) read(e indexEntry) (rec record, err error) {
+	b := make([]byte, e.Length)
+	if _, err = j.data.ReadAt(b, e.Offset); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &rec); err != nil {
+		err = errors.New(fmt.Sprintf("Malformed journal record %q: %v", e.ID, err))
+	}
+	return
+}
+
+// write appends rec to the journal and indexes it, returning once the record is on
+// disk. A record that is written but not indexed is indexed when the journal is next
+// opened.
+func (j *journal) write(rec record) (err error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	if _, err = j.data.Write(b); err == nil {
+		err = j.data.Sync()
+	}
+	if err != nil {
+		// Leave no partial record to be followed by the next.
+		j.data.Truncate(j.size)
+		return
+	}
+	e := newIndexEntry(rec.Notification, j.size, int64(len(b)))
+	j.size += int64(len(b))
+	if err = j.appendIndex(e); err == nil {
+		err = j.index.Sync()
+	}
+	if err != nil {
+		log.Printf("Could not index journal record %q: %v", e.ID, err)
+		if _, ok := j.ids[e.ID]; !ok {
+			j.insert(e)
+		}
+	}
+	return nil
+}
+
+func (j *journal) accept(n *common.Notification, f func(r *common.Receipt) error) (a common.Acceptance, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i, ok := j.subs[n.Serial+"/"+n.Submission]; ok && n.Submission != "" {
+		rec, err := j.read(j.entries[i])
+		if err != nil {
+			return a, err
+		}
+		if rec.Receipt != nil {
+			a.Receipt = *rec.Receipt
+		}
+		a.Retry = true
+		return a, nil
+	}
+
+	a.Receipt = common.Receipt{Submission: n.Submission, Time: time.Now().UTC(), Serial: n.Serial}
+	if a.ID, err = common.NewID(); err != nil {
+		return
+	}
+	n.ID, n.Accepted = a.ID, &a.Time
+	if err = f(&a.Receipt); err != nil {
+		return
+	}
+	err = j.write(record{Notification: n, Receipt: &a.Receipt})
+	return
+}
+
+var errNoAfter = errors.New("No notification to continue the query after.")
+
+// find reads the records of the notifications matching q from the journal. Next is the
+// ID of the last notification returned if there are further matches.
+func (j *journal) find(q common.Query, limit int) (r common.QueryResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start := 0
+	if q.After != "" {
+		i, ok := j.ids[q.After]
+		if !ok {
+			return r, errNoAfter
+		}
+		start = i + 1
+	}
+	for _, e := range j.entries[start:] {
+		if !e.matches(q) {
+			continue
+		}
+		if len(r.Notifications) == limit {
+			r.Next = r.Notifications[limit-1].ID
+			break
+		}
+		rec, err := j.read(e)
+		if err != nil {
+			return r, err
+		}
+		r.Notifications = append(r.Notifications, *rec.Notification)
+	}
+	return
+}
+
+func (j *journal) add(n *common.Notification, r *common.Receipt) (ok bool, err error) {
+	if n.ID == "" {
+		return false, errors.New("Notification has no ID.")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, held := j.ids[n.ID]; held {
+		return false, nil
+	}
+	if err = j.write(record{Notification: n, Receipt: r}); err != nil {
+		return
+	}
+	return true, nil
+}
+
+func (j *journal) close() (err error) {
+	err = j.data.Close()
+	if ierr := j.index.Close(); err == nil {
+		err = ierr
+	}
+	return
+}
+
+// importLog adds the notifications logged as JSON lines to r by earlier versions of the
+// server to s, with their receipts from receipts, returning the number added and the
+// number already held. A notification logged before IDs were assigned is identified by
+// the digest of its line number and encoding, so that identical notifications logged
+// more than once are each kept and importing the same log again adds nothing.
+func importLog(s noteStore, r io.Reader, receipts map[string]common.Receipt) (added, held int, err error) {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return added, held, nil
+		} else if err != nil && err != io.EOF {
+			return added, held, err
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			continue
+		}
+		var n common.Notification
+		if err = json.Unmarshal(b, &n); err != nil {
+			log.Printf("Skipping malformed notification on line %d: %v", line, err)
+			continue
+		}
+		var rcpt *common.Receipt
+		if n.ID == "" {
+			h := sha256.Sum256(append([]byte(fmt.Sprintf("%d\n", line)), bytes.TrimSpace(b)...))
+			n.ID = hex.EncodeToString(h[:16])
+		} else if rc, ok := receipts[n.ID]; ok {
+			rcpt = &rc
+		}
+		ok, err := s.add(&n, rcpt)
+		if err != nil {
+			return added, held, err
+		}
+		if ok {
+			added++
+		} else {
+			held++
+		}
+	}
+}
+
+// readSubmissions returns the receipts, by ID, of the notifications accepted with a
+// submission identifier that were recorded as JSON lines in the file at path by earlier
+// versions of the server. A missing file holds no receipts.
+func readSubmissions(path string) (receipts map[string]common.Receipt, err error) {
+	receipts = make(map[string]common.Receipt)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return receipts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return receipts, nil
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var a common.Acceptance
+		if json.Unmarshal(b, &a) != nil || a.ID == "" {
+			// A record cut short by a crash is ignored, as it was by earlier versions.
+			continue
+		}
+		receipts[a.ID] = a.Receipt
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestJournal returns a directory holding a journal of n accepted notifications, and
+// their IDs in order.
+func newTestJournal(t *testing.T, n int) (dir string, ids []string) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatalf("unexpected error opening journal: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		a, err := j.accept(&common.Notification{
+			Serial:     "1",
+			Submission: fmt.Sprint(i),
+			Name:       fmt.Sprintf("note %d", i),
+		}, func(*common.Receipt) error { return nil })
+		if err != nil {
+			t.Fatalf("unexpected error accepting notification: %v", err)
+		}
+		ids = append(ids, a.ID)
+	}
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, ids
+}
+
+// journalIDs opens the journal in dir and returns the IDs of the notifications it holds.
+func journalIDs(t *testing.T, dir string) (ids []string, err error) {
+	j, err := openJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer j.close()
+	r, err := j.find(common.Query{}, 100)
+	if err != nil {
+		t.Fatalf("unexpected error reading journal: %v", err)
+	}
+	for _, n := range r.Notifications {
+		ids = append(ids, n.ID)
+	}
+	return ids, nil
+}
+
+func appendFile(t *testing.T, path, s string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestJournalTornTail(t *testing.T) {
+	for _, tail := range []string{
+		`{"Notification":{"ID":"torn"`,
+		`{"Notification":{"ID":"torn","Name":"","Category":"","Tool":{},"Slop":null,"Output":null}}`,
+		`garbage`,
+	} {
+		dir, want := newTestJournal(t, 2)
+		path := filepath.Join(dir, journalFile)
+		size := fileSize(t, path)
+		appendFile(t, path, tail)
+
+		ids, err := journalIDs(t, dir)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tail, err)
+		} else if !reflect.DeepEqual(ids, want) {
+			t.Errorf("%q: got IDs %v, want %v", tail, ids, want)
+		}
+		if got := fileSize(t, path); got != size {
+			t.Errorf("%q: journal is %d bytes after truncation, want %d", tail, got, size)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	for _, line := range []string{
+		"garbage\n",
+		"{}\n",
+		`{"Notification":{"ID":"torn"` + "\n",
+	} {
+		dir, want := newTestJournal(t, 2)
+		path := filepath.Join(dir, journalFile)
+		size := fileSize(t, path)
+		appendFile(t, path, line)
+
+		// A record following the corrupt line must not be lost.
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := b[strings.LastIndex(string(b[:size-1]), "\n")+1 : size]
+		appendFile(t, path, string(last))
+		total := fileSize(t, path)
+
+		_, err = journalIDs(t, dir)
+		if err == nil {
+			t.Errorf("%q: expected error opening journal", line)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("offset %d", size)) {
+			t.Errorf("%q: error does not give the offset %d: %v", line, size, err)
+		}
+		if got := fileSize(t, path); got != total {
+			t.Errorf("%q: journal is %d bytes after failed open, want %d", line, got, total)
+		}
+
+		// Removing the corrupt line recovers the journal.
+		b, err = ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, append(b[:size:size], last...), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ids, err := journalIDs(t, dir)
+		if err != nil {
+			t.Errorf("%q: unexpected error after repair: %v", line, err)
+		} else if !reflect.DeepEqual(ids, append(want, want[1])) {
+			t.Errorf("%q: got IDs %v after repair, want %v", line, ids, append(want, want[1]))
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournalIndex(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		index func(path string) error
+	}{
+		{name: "missing", index: os.Remove},
+		{name: "empty", index: func(path string) error { return os.Truncate(path, 0) }},
+		{name: "stale", index: func(path string) error {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, b[:strings.Index(string(b), "\n")+1], 0600)
+		}},
+		{name: "torn", index: func(path string) error {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, b[:len(b)-10], 0600)
+		}},
+		{name: "corrupt", index: func(path string) error {
+			return ioutil.WriteFile(path, []byte(`{"ID":"x","Offset":0,"Length":1000000}`+"\n"), 0600)
+		}},
+	} {
+		dir, want := newTestJournal(t, 3)
+		path := filepath.Join(dir, indexFile)
+		size := fileSize(t, path)
+		if err := test.index(path); err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := journalIDs(t, dir)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(ids, want) {
+			t.Errorf("%s: got IDs %v, want %v", test.name, ids, want)
+		}
+		if got := fileSize(t, path); got != size {
+			t.Errorf("%s: index is %d bytes after rebuilding, want %d", test.name, got, size)
+		}
+		os.RemoveAll(dir)
+	}
+}
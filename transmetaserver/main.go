@@ -21,12 +21,14 @@ import (
 	"code.google.com/p/gdacap.transmeta/common"
 	"code.google.com/p/go.net/websocket"
 
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -34,15 +36,25 @@ import (
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
 	config   = ".transmetaserver"
 	certfile = "authority.pem"
+	notesdir = "notes"
+
+	// statesfile holds the final verification states of stored files below the notes
+	// directory.
+	statesfile = "states"
+
+	// submitfile holds the receipts of submissions accepted by earlier versions of the
+	// server, which are imported with the notifications they belong to.
+	submitfile = "submissions"
 )
 
 var (
-	server        string // host receiving files by scp
+	server        string // host receiving files by scp when not uploaded
 	subuser       string // user on the server accepting file submission
 	subpath       string // path in ~subuser for copy
 	targetdir     string
@@ -51,13 +63,29 @@ var (
 	username     string   // messenger admin
 	organisation []string // optional
 
-	laddr  string
-	port   int
-	strict bool
+	laddr     string
+	port      int
+	strict    bool
+	hashes    []string // accepted hash algorithms in order of preference
+	backends  []string // advertised transfer backends in order of preference
+	encodings []string // accepted transfer encodings
 
 	confdir string
 	keygen  bool
 	force   bool
+	keypair tls.Certificate
+	signer  crypto.Signer // private key of keypair, signing receipts
+
+	verifiers  int
+	verify     *verifier
+	partialAge time.Duration
+	statusAge  time.Duration
+	notes      noteStore
+	notesDir   string
+	importFile string
+
+	backendList, encodingList, hashList *string
+	help                                *bool
 
 	random = rand.Reader
 )
@@ -72,7 +100,8 @@ func init() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, " %s -fhost <scp target> -fuser <scp target user> [-fpath <scp target path>] > <JSON>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s -fhost <scp target> -fuser <scp target user> [-fpath <scp target path>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " %s -import <JSON log>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, " %s -keygen -u <user>\n", os.Args[0])
 		fmt.Fprintln(os.Stderr)
 		flag.PrintDefaults()
@@ -85,10 +114,22 @@ func init() {
 	flag.IntVar(&port, "port", 9001, "Over 9000.")
 	flag.BoolVar(&strict, "strict", false, "Required level of authentication: false - provide cert, true - provide CA-signed cert.")
 	flag.StringVar(&laddr, "laddr", "0.0.0.0", "Addresses to listen to.")
+	flag.IntVar(&verifiers, "verifiers", 2, "Number of files verified concurrently.")
+	flag.DurationVar(&partialAge, "partialage", 7*24*time.Hour, "Age after which the partial files of abandoned uploads are removed (0 to keep them).")
+	flag.DurationVar(&statusAge, "statusage", 7*24*time.Hour, "Age after which the verification states of stored files are forgotten (0 to keep them).")
+	flag.StringVar(&notesDir, "notes", filepath.Join(confdir, notesdir), "Directory of the journal of accepted notifications.")
+	flag.StringVar(&importFile, "import", "", "Import notifications logged as JSON lines by earlier versions, or - for standard input, with their receipts from the submissions file in the configuration directory, and exit.")
+	backendList = flag.String("backends", "upload,http,rsync,scp", "Comma separated transfer backends offered to clients in order of preference: upload, http, rsync, scp or local.")
+	encodingList = flag.String("compress", strings.Join(common.Encodings, ","), "Comma separated transfer encodings accepted; empty to accept none.")
+	hashList = flag.String("hashes", "sha256,sha512,blake2b,sha1", "Comma separated hash algorithms accepted for new files in order of preference.")
 	flag.BoolVar(&force, "f", false, "Force overwrite of files.")
 	flag.BoolVar(&keygen, "keygen", false, "Generate a key pair for the specified user.")
-	help := flag.Bool("help", false, "Print this usage message.")
+	help = flag.Bool("help", false, "Print this usage message.")
+}
 
+// parseFlags parses and checks the command line. It is not run from init so that the
+// package can be tested.
+func parseFlags() {
 	flag.Parse()
 
 	if *help {
@@ -98,10 +139,38 @@ func init() {
 
 	requiredFlags()
 
-	if keygen {
+	if keygen || importFile != "" {
 		return
 	}
 
+	hashes = strings.Split(*hashList, ",")
+	for _, h := range hashes {
+		if _, err := common.NewHash(h); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *encodingList != "" {
+		encodings = strings.Split(*encodingList, ",")
+	}
+	for _, e := range encodings {
+		if _, ok := common.Negotiate([]string{e}, common.Encodings); !ok {
+			fmt.Fprintf(os.Stderr, "Unknown encoding: %q\n", e)
+			os.Exit(1)
+		}
+	}
+
+	backends = strings.Split(*backendList, ",")
+	for _, b := range backends {
+		switch b {
+		case "upload", "http", "rsync", "scp", "local":
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown backend: %q\n", b)
+			os.Exit(1)
+		}
+	}
+
 	userAndServer = fmt.Sprintf("%s@%s:~%s/", subuser, server, filepath.Join(subuser, subpath))
 	if u, err := user.Lookup(subuser); err != nil {
 		fmt.Fprintf(os.Stderr, "Could not get user: %s, %v", subuser, err)
@@ -120,6 +189,9 @@ func requiredFlags() {
 		}
 		return
 	}
+	if importFile != "" {
+		return
+	}
 
 	failed := []string{}
 	if server == "" {
@@ -136,61 +208,234 @@ func requiredFlags() {
 }
 
 func RequestServer(ws *websocket.Conn) {
+	if client, ok := handshake(ws); ok {
+		request(ws, client)
+		return
+	}
+	reply(ws, common.OK())
+}
+
+// request checks the outputs offered by the client against the store and tells it how
+// to send those that are needed.
+func request(ws *websocket.Conn, client common.Hello) {
 	var (
-		m     string
-		files []common.Output
+		m      string
+		offer  common.HashOffer
+		agreed common.HashOffer
+		alg    string
+		ok     bool
+		files  []common.Output
 	)
 
 	if err := websocket.Message.Receive(ws, &m); err != nil {
-		log.Fatalf("Websocket fault: %v", err)
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err := json.Unmarshal([]byte(m), &offer); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+	if alg, ok = common.Negotiate(offer.Hashes, hashes); !ok {
+		reply(ws, common.Errorf(common.CodeUnsupported, "", "no acceptable hash algorithm offered - server accepts %s", strings.Join(hashes, ", ")))
+		goto bye
+	}
+	agreed = common.HashOffer{Hashes: []string{alg}}
+	for _, e := range offer.Encodings {
+		if _, ok := common.Negotiate([]string{e}, encodings); ok && client.Has(common.FeatureCompress) {
+			agreed.Encodings = append(agreed.Encodings, e)
+		}
+	}
+	if err := replyData(ws, common.KindData, agreed); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+
+	if err := websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
 	}
 	if err := json.Unmarshal([]byte(m), &files); err != nil {
-		websocket.Message.Send(ws, "Error: bad message - could not parse")
-		log.Fatalf("Bad message: malformed JSON %q: %v.", m, err)
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
 		goto bye
 	}
 	for i, f := range files {
 		if f.Size == nil {
 			continue
 		}
-		if exists, collision, err := common.Collision(filepath.Join(targetdir, f.Hash), *f.Size); err != nil {
-			websocket.Message.Send(ws, fmt.Sprintf("Error: Server fault: %v.", err))
-		} else {
-			if collision {
+		if fa, _, err := common.ParseDigest(f.Hash); err != nil {
+			reply(ws, common.Errorf(common.CodeBadMessage, f.OriginalName, "%v", err))
+			goto bye
+		} else if fa != alg {
+			reply(ws, common.Errorf(common.CodeBadMessage, f.OriginalName, "%q not hashed with agreed algorithm %s", f.OriginalName, alg))
+			goto bye
+		}
+		files[i].Corrupt = nil
+		if _, ok := common.Negotiate([]string{f.Encoding}, agreed.Encodings); !ok {
+			files[i].Encoding = ""
+		}
+		if f.Manifest != nil {
+			if err := f.Manifest.Check(f.Hash); err != nil {
+				reply(ws, common.Errorf(common.CodeBadMessage, f.OriginalName, "%q: %v", f.OriginalName, err))
+				goto bye
+			} else if int64(len(f.Manifest.Bytes())) != *f.Size {
+				reply(ws, common.Errorf(common.CodeBadMessage, f.OriginalName, "%q: manifest size mismatch", f.OriginalName))
+				goto bye
+			}
+			for j, e := range f.Manifest.Entries {
+				if ea, _, _ := common.ParseDigest(e.Hash); ea != alg {
+					reply(ws, common.Errorf(common.CodeBadMessage, f.OriginalName+"/"+e.Path, "%q not hashed with agreed algorithm %s", f.OriginalName+"/"+e.Path, alg))
+					goto bye
+				}
+				esn, _ := common.StoreName(e.Hash)
+				exists, err := common.Collision(nil, filepath.Join(targetdir, esn), e.Hash, e.Size)
+				if err != nil {
+					if _, ok := err.(*common.CollisionError); ok {
+						reply(ws, common.Warningf(common.CodeCollision, f.OriginalName+"/"+e.Path, "%q collides with a different stored file; refusing to accept it. Please de-collision and try again.", f.OriginalName+"/"+e.Path))
+						continue // Don't set Sent status - indicates collision
+					}
+					reply(ws, common.Errorf(common.CodeServerFault, f.OriginalName+"/"+e.Path, "Server fault on %q: %v.", f.OriginalName+"/"+e.Path, err))
+					log.Printf("Server fault: %v", err)
+					goto bye
+				}
+				files[i].Manifest.Entries[j].Sent = &exists
+			}
+		}
+		sn, _ := common.StoreName(f.Hash)
+		fp := filepath.Join(targetdir, sn)
+		if exists, err := common.Collision(nil, fp, f.Hash, *f.Size); err != nil {
+			if _, ok := err.(*common.CollisionError); ok {
+				reply(ws, common.Warningf(common.CodeCollision, f.OriginalName, "%q collides with a different stored file; refusing to accept it. Please de-collision and try again.", f.OriginalName))
 				continue // Don't set Sent status - indicates collision
-			} else {
-				files[i].Sent = new(bool)
-				*files[i].Sent = exists
+			}
+			reply(ws, common.Errorf(common.CodeServerFault, f.OriginalName, "Server fault on %q: %v.", f.OriginalName, err))
+			log.Printf("Server fault: %v", err)
+			goto bye
+		} else {
+			files[i].Sent = new(bool)
+			*files[i].Sent = exists
+			if !exists && f.Chunks != nil && client.Has(common.FeatureRepair) {
+				if ok, _, _ := common.Exists(fp); ok {
+					// A damaged or partial copy is stored; ask only for the bad chunks.
+					files[i].Corrupt, _ = common.CorruptChunks(fp, f.Chunks, *f.Size)
+				}
 			}
 		}
 	}
-	if err := websocket.JSON.Send(ws, files); err != nil {
-		log.Fatal(err)
+	if err := replyData(ws, common.KindData, files); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
 	}
 
-	websocket.Message.Send(ws, userAndServer)
+	replyData(ws, common.KindData, advertise(ws.Request().Host, client))
 
 bye:
-	websocket.Message.Send(ws, "Thankyou.")
+	reply(ws, common.OK())
+}
+
+// advertise returns the transfer backends offered to clients connecting to host that
+// support the features needed to use them.
+func advertise(host string, client common.Hello) (bs []common.Backend) {
+	for _, b := range backends {
+		switch b {
+		case "upload":
+			if client.Has(common.FeatureUpload) {
+				bs = append(bs, common.Backend{Name: b})
+			}
+		case "http":
+			bs = append(bs, common.Backend{Name: b, Target: fmt.Sprintf("https://%s/store/", host)})
+		case "rsync", "scp":
+			if client.Has(common.FeatureIngest) {
+				bs = append(bs, common.Backend{Name: b, Target: userAndServer + stagingDir + "/", Staged: true})
+			}
+		case "local":
+			if client.Has(common.FeatureIngest) {
+				bs = append(bs, common.Backend{Name: b, Target: filepath.Join(targetdir, stagingDir), Staged: true})
+			}
+		}
+	}
+	return
+}
+
+// reply sends the message m to the client.
+func reply(ws *websocket.Conn, m common.Message) error {
+	return websocket.JSON.Send(ws, m)
+}
+
+// replyData sends v to the client in a message of the given kind.
+func replyData(ws *websocket.Conn, kind string, v interface{}) error {
+	m, err := common.NewData(kind, v)
+	if err != nil {
+		return err
+	}
+	return reply(ws, m)
+}
+
+// handshake receives the Hello that opens every websocket endpoint and replies with the protocol version and features agreed with the client. If ok is false
+// the client is incompatible and has been sent an error, or the connection failed.
+func handshake(ws *websocket.Conn) (client common.Hello, ok bool) {
+	var m string
+	if err := websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	// Clients that predate the handshake open with their request, which is
+	// rejected as a Hello without a version.
+	var hello common.Hello
+	json.Unmarshal([]byte(m), &hello)
+	client, err := common.Agree(hello)
+	if err != nil {
+		if hello.Version < 2 {
+			// Clients before version 2 do not understand message envelopes.
+			websocket.Message.Send(ws, fmt.Sprintf("Error: %v.", err))
+		} else {
+			reply(ws, common.Errorf(common.CodeIncompatible, "", "%v.", err))
+		}
+		log.Printf("Rejected client %s: %v", peer(ws.Request()), err)
+		return
+	}
+	if err = replyData(ws, common.KindData, client); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	return client, true
 }
 
+// NotificationServer logs a notification and queues its sent outputs for verification.
+// Clients supporting the status feature are sent a JSON list of the pending Status of
+// each queued output; the results of verification are available from /status.
 func NotificationServer(ws *websocket.Conn) {
+	if client, ok := handshake(ws); ok {
+		notify(ws, client)
+		return
+	}
+	reply(ws, common.OK())
+}
+
+// notify runs the exchange of NotificationServer after the handshake.
+func notify(ws *websocket.Conn, client common.Hello) {
 	var (
-		m    string
-		note common.Notification
+		m      string
+		note   common.Notification
+		sent   []common.Output
+		a      common.Acceptance
+		states []common.Status
+		err    error
 	)
 
 	if err := websocket.Message.Receive(ws, &m); err != nil {
-		log.Fatalf("Websocket fault: %v", err)
+		log.Printf("Websocket fault: %v", err)
+		return
 	}
 	if err := json.Unmarshal([]byte(m), &note); err != nil {
-		websocket.Message.Send(ws, "bad message - could not parse")
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
 		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
 		goto bye
 	}
 
 	if request := ws.Request(); len(request.TLS.PeerCertificates) == 0 {
-		websocket.Message.Send(ws, "bad message - identity unverified")
+		reply(ws, common.Errorf(common.CodeAuth, "", "identity unverified"))
 		log.Printf("Bad message: No peer certificate %#v.", request.TLS)
 		goto bye
 	} else {
@@ -199,40 +444,262 @@ func NotificationServer(ws *websocket.Conn) {
 	}
 
 	for i, file := range note.Output {
-		fp := filepath.Join(targetdir, file.Hash)
 		if file.Sent == nil { // Protect against malformed notification - Sent == nil would panic.
 			continue
 		}
-		var sent bool
-		if sent, note.Output[i].Sent = *file.Sent, nil; !sent {
+		if file.Manifest != nil {
+			for j := range file.Manifest.Entries {
+				note.Output[i].Manifest.Entries[j].Sent = nil
+			}
+		}
+		if *file.Sent {
+			sent = append(sent, file)
+		}
+		note.Output[i].Sent = nil
+	}
+
+	// A retried notification is not stored or verified again.
+	a, err = notes.accept(&note, func(r *common.Receipt) error {
+		r.Username = note.Username
+		for _, file := range note.Output {
+			r.Outputs = append(r.Outputs, file.Hash)
+		}
+		return r.Sign(signer, keypair.Certificate[0])
+	})
+	if err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, "", "Notification not stored due to internal error, please notify admin: %v", err))
+		log.Printf("Notification not stored: %v", err)
+		goto bye
+	}
+	if a.Retry {
+		log.Printf("Submission %q from %s was accepted at %v; not stored again.", a.Submission, note.Serial, a.Time)
+	} else {
+		log.Printf("Stored notification %s of %q from %s.", a.ID, note.Name, note.Serial)
+	}
+	// Outputs are queued for verification once the notification is durable. A retry
+	// reports the current state of each output, queueing it again only if its
+	// verification has been forgotten.
+	for _, file := range sent {
+		st := verify.lookup([]string{file.Hash}, nil)[0]
+		if !a.Retry || st.State == common.StatusUnknown {
+			st = verify.enqueue(file)
+		}
+		states = append(states, st)
+	}
+	if len(states) > 0 && client.Has(common.FeatureStatus) {
+		replyData(ws, common.KindStatus, states)
+	}
+	if client.Has(common.FeatureSubmission) {
+		replyData(ws, common.KindData, a)
+	}
+
+bye:
+	reply(ws, common.OK())
+}
+
+// verifyOutput checks the stored copy of file, returning whether it verified and
+// messages for the submitter.
+func verifyOutput(file common.Output) (ok bool, msgs []common.Message) {
+	alg, _, err := common.ParseDigest(file.Hash)
+	if err != nil {
+		return false, []common.Message{common.Errorf(common.CodeBadMessage, file.OriginalName, "%q has a bad hash: %v.", file.OriginalName, err)}
+	}
+	algs, want := []string{alg}, []string{file.Hash}
+	for a, d := range file.Digests {
+		if _, err := common.NewHash(a); err != nil {
+			msgs = append(msgs, common.Errorf(common.CodeBadMessage, file.OriginalName, "%q has a bad %s digest: %v.", file.OriginalName, a, err))
 			continue
 		}
-		if ok, _, err := common.Exists(fp); err != nil {
-			websocket.Message.Send(ws, fmt.Sprintf("Server fault: %v.", err))
+		algs, want = append(algs, a), append(want, d)
+	}
+	sn, _ := common.StoreName(file.Hash)
+	fp := filepath.Join(targetdir, sn)
+	ok, m := verifyStored(file.OriginalName, fp, algs, want)
+	ok = ok && len(msgs) == 0
+	msgs = append(msgs, m...)
+	if !ok {
+		if file.Chunks != nil && file.Size != nil {
+			if bad, err := common.CorruptChunks(fp, file.Chunks, *file.Size); err != nil {
+				msgs = append(msgs, common.Errorf(common.CodeServerFault, file.OriginalName, "%q chunks could not be checked: %v.", file.OriginalName, err))
+			} else if len(bad) > 0 {
+				msgs = append(msgs, common.Errorf(common.CodeCorrupt, file.OriginalName, "%q has %d corrupt chunks %v of %d; resubmit to resend them.", file.OriginalName, len(bad), bad, len(file.Chunks.Leaves)))
+			}
+		}
+		return
+	}
+
+	if file.Manifest != nil {
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
 			log.Printf("Server fault: %v", err)
-		} else if !ok {
-			websocket.Message.Send(ws, fmt.Sprintf("%q is not on the server at %q.", file.OriginalName, filepath.Join("...", file.Hash)))
-		} else {
-			if hs, _ := common.HashFile(common.HashFunc, fp); hs != file.Hash {
-				websocket.Message.Send(ws, fmt.Sprintf("%q did not verify correctly: %s != %s.", file.OriginalName, hs, file.Hash))
-			} else {
-				websocket.Message.Send(ws, fmt.Sprintf("%q verified correctly.", file.OriginalName))
+			return false, append(msgs, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault verifying %q: %v.", file.OriginalName, err))
+		}
+		mf, err := common.ParseManifest(b)
+		if err != nil {
+			return false, append(msgs, common.Errorf(common.CodeMismatch, file.OriginalName, "%q has a bad manifest: %v.", file.OriginalName, err))
+		}
+		for _, e := range mf.Entries {
+			name := file.OriginalName + "/" + e.Path
+			ea, _, err := common.ParseDigest(e.Hash)
+			if err != nil {
+				msgs = append(msgs, common.Errorf(common.CodeBadMessage, name, "%q has a bad hash: %v.", name, err))
+				ok = false
+				continue
 			}
+			esn, _ := common.StoreName(e.Hash)
+			eok, m := verifyStored(name, filepath.Join(targetdir, esn), []string{ea}, []string{e.Hash})
+			if !eok {
+				msgs = append(msgs, m...)
+				ok = false
+			}
+		}
+		if !ok {
+			return
 		}
+		return true, append(msgs, common.Infof(file.OriginalName, "%q verified correctly (%d files).", file.OriginalName, len(mf.Entries)))
 	}
 
-	if b, err := json.Marshal(note); err != nil {
-		websocket.Message.Send(ws, fmt.Sprintf("Notification not logged due to internal error, please notify admin: %v", err))
-		log.Printf("Notification not logged - JSON fault: %v", err)
-	} else {
-		fmt.Println(string(b))
+	return true, append(msgs, common.Infof(file.OriginalName, "%q verified correctly.", file.OriginalName))
+}
+
+// verifyStored hashes the stored file fp with algs and compares the results with want.
+func verifyStored(name, fp string, algs, want []string) (ok bool, msgs []common.Message) {
+	if ok, _, err := common.Exists(fp); err != nil {
+		log.Printf("Server fault: %v", err)
+		return false, []common.Message{common.Errorf(common.CodeServerFault, name, "Server fault: %v.", err)}
+	} else if !ok {
+		return false, []common.Message{common.Errorf(common.CodeMissing, name, "%q is not on the server at %q.", name, filepath.Join("...", filepath.Base(fp)))}
+	}
+	hs, _, err := common.HashFile(fp, algs...)
+	if err != nil {
+		log.Printf("Server fault: %v", err)
+		return false, []common.Message{common.Errorf(common.CodeServerFault, name, "Server fault verifying %q: %v.", name, err)}
+	}
+	ok = true
+	for j := range hs {
+		if !common.EqualDigests(hs[j], want[j]) {
+			msgs = append(msgs, common.Errorf(common.CodeMismatch, name, "%q did not verify correctly: %s != %s.", name, hs[j], want[j]))
+			ok = false
+		}
 	}
+	return
+}
+
+// RepairServer rewrites the corrupt chunks of a stored file. The client sends the
+// Output describing the file, including its Merkle tree, and is told which chunks to
+// send. Each chunk is then sent as a single binary message in that order. The chunks are
+// written to a copy of the stored file in the work directory, which replaces the
+// stored file only if it matches the digest the file is stored under, and is quarantined
+// otherwise.
+func RepairServer(ws *websocket.Conn) {
+	var (
+		m    string
+		file common.Output
+		bad  []int
+		alg  string
+		sn   string
+		fp   string
+		src  *os.File
+		f    *os.File
+		hs   []string
+		size int64
+		err  error
+	)
+
+	if err = websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err = json.Unmarshal([]byte(m), &file); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+	if file.Chunks == nil || file.Size == nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, file.OriginalName, "no chunks to repair"))
+		goto bye
+	}
+	if alg, _, err = common.ParseDigest(file.Hash); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, file.OriginalName, "%v", err))
+		goto bye
+	}
+	sn, _ = common.StoreName(file.Hash)
+	fp = filepath.Join(targetdir, sn)
+	if bad, err = common.CorruptChunks(fp, file.Chunks, *file.Size); err != nil {
+		reply(ws, common.Errorf(common.CodeMissing, file.OriginalName, "cannot repair %q: %v.", file.OriginalName, err))
+		goto bye
+	}
+	if err = replyData(ws, common.KindData, bad); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+
+	if f, err = ioutil.TempFile(filepath.Join(targetdir, workDir), ".repair-"); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name()) // Fails harmlessly once renamed.
+	}()
+	if src, err = os.Open(fp); err == nil {
+		_, err = io.Copy(f, src)
+		src.Close()
+	}
+	if err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	for _, i := range bad {
+		var b []byte
+		if err = websocket.Message.Receive(ws, &b); err != nil {
+			log.Printf("Websocket fault: %v", err)
+			return
+		}
+		off, n := file.Chunks.Chunk(i, *file.Size)
+		if ok, _ := file.Chunks.CheckChunk(i, b); !ok || int64(len(b)) != n {
+			reply(ws, common.Errorf(common.CodeMismatch, file.OriginalName, "chunk %d of %q did not verify.", i, file.OriginalName))
+			goto bye
+		}
+		if _, err = f.WriteAt(b, off); err != nil {
+			reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+			goto bye
+		}
+	}
+	if err = f.Truncate(*file.Size); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+		goto bye
+	}
+
+	if hs, size, err = common.HashFile(f.Name(), alg); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+		goto bye
+	} else if !common.EqualDigests(hs[0], file.Hash) {
+		if err = quarantine(f.Name(), Quarantine{Name: file.OriginalName, Source: peer(ws.Request()), Expected: file.Hash, Got: hs[0], Size: size}); err != nil {
+			log.Printf("Server fault: %v", err)
+		}
+		reply(ws, common.Errorf(common.CodeMismatch, file.OriginalName, "%q did not verify correctly after repair: %s != %s.", file.OriginalName, hs[0], file.Hash))
+		goto bye
+	}
+	if err = commit(f.Name(), hs[0]); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, file.OriginalName, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	log.Printf("Repaired %d chunks of %q.", len(bad), sn)
 
 bye:
-	websocket.Message.Send(ws, "Thankyou.")
+	reply(ws, common.OK())
 }
 
 func main() {
+	parseFlags()
+
 	if keygen {
 		if serial, err := common.Keygen(username, organisation, true, confdir, force); err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -242,10 +709,56 @@ func main() {
 		os.Exit(0)
 	}
 
+	var err error
+	if notes, err = openJournal(notesDir); err != nil {
+		log.Fatalf("Could not open notification journal: %v", err)
+	}
+	if importFile != "" {
+		f := os.Stdin
+		if importFile != "-" {
+			if f, err = os.Open(importFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		receipts, err := readSubmissions(filepath.Join(confdir, submitfile))
+		if err != nil {
+			log.Fatalf("Could not read submissions: %v", err)
+		}
+		added, held, err := importLog(notes, f, receipts)
+		log.Printf("Imported %d notifications; %d were already held.", added, held)
+		if cerr := notes.close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if keypair, err = tls.LoadX509KeyPair(
+		filepath.Join(confdir, common.Pubkey),
+		filepath.Join(confdir, common.Privkey)); err != nil {
+		log.Fatalf("Could not read key pair from %q: %v", confdir, err)
+	}
+	var ok bool
+	if signer, ok = keypair.PrivateKey.(crypto.Signer); !ok {
+		log.Fatalf("Cannot sign receipts with key in %q.", filepath.Join(confdir, common.Privkey))
+	}
+
+	if err = makeStore(); err != nil {
+		log.Fatalf("Could not create store: %v", err)
+	}
+	if verify, err = newVerifier(verifiers, filepath.Join(notesDir, statesfile), statusAge); err != nil {
+		log.Fatalf("Could not open verification states: %v", err)
+	}
+	if partialAge > 0 {
+		go expirePartials(partialAge)
+	}
+
 	server := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", laddr, port),
 		Handler:   nil,
-		TLSConfig: &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+		TLSConfig: &tls.Config{ClientAuth: tls.RequireAnyClientCert, Certificates: []tls.Certificate{keypair}},
 	}
 	if strict {
 		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
@@ -264,7 +777,12 @@ func main() {
 
 	http.Handle("/request", websocket.Handler(RequestServer))
 	http.Handle("/notify", websocket.Handler(NotificationServer))
-	log.Fatalf("ListenAndServeTLS: %v", server.ListenAndServeTLS(
-		filepath.Join(confdir, common.Pubkey),
-		filepath.Join(confdir, common.Privkey)))
+	http.Handle("/repair", negotiated("repair", RepairServer))
+	http.Handle("/status", negotiated("status", StatusServer))
+	http.Handle("/query", negotiated("query", QueryServer))
+	http.Handle("/upload", negotiated("upload", UploadServer))
+	http.Handle("/ingest", negotiated("ingest", IngestServer))
+	http.Handle("/session", websocket.Handler(SessionServer))
+	http.HandleFunc("/store/", StoreServer)
+	log.Fatalf("ListenAndServeTLS: %v", server.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,81 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"encoding/json"
+	"log"
+)
+
+// Number of notifications returned in each page of query results.
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// QueryServer finds stored notifications. The client, which must present a certificate,
+// sends a Query and receives a QueryResult holding a page of the matching notifications.
+func QueryServer(ws *websocket.Conn) {
+	var (
+		m     string
+		q     common.Query
+		limit int
+		r     common.QueryResult
+		err   error
+	)
+
+	if err := websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err := json.Unmarshal([]byte(m), &q); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+	if request := ws.Request(); request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		reply(ws, common.Errorf(common.CodeAuth, "", "identity unverified"))
+		log.Printf("Bad message: No peer certificate %#v.", request.TLS)
+		goto bye
+	}
+
+	switch limit = q.Limit; {
+	case limit < 1:
+		limit = defaultQueryLimit
+	case limit > maxQueryLimit:
+		limit = maxQueryLimit
+	}
+	if r, err = notes.find(q, limit); err == errNoAfter {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "%v", err))
+		goto bye
+	} else if err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, "", "Query failed due to internal error, please notify admin: %v", err))
+		log.Printf("Query failed: %v", err)
+		goto bye
+	}
+	if err = replyData(ws, common.KindData, r); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+
+bye:
+	reply(ws, common.OK())
+}
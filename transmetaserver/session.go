@@ -0,0 +1,118 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// SessionServer runs a sequence of exchanges over a single connection so that a client
+// submitting many outputs pays for one TLS handshake. After the Hello, the client names
+// each exchange with a common.Session message and the exchange proceeds as it would over
+// its own endpoint. The session ends when the client closes the connection or sends a
+// message that is not understood.
+func SessionServer(ws *websocket.Conn) {
+	var (
+		m      string
+		client common.Hello
+		op     common.Session
+		ok     bool
+	)
+
+	if client, ok = handshake(ws); !ok {
+		reply(ws, common.OK())
+		return
+	}
+	for {
+		if err := websocket.Message.Receive(ws, &m); err != nil {
+			if err != io.EOF {
+				log.Printf("Websocket fault: %v", err)
+			}
+			return
+		}
+		op = common.Session{}
+		if err := json.Unmarshal([]byte(m), &op); err != nil {
+			reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+			log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+			reply(ws, common.OK())
+			return
+		}
+		if !permitted(ws, client, op.Exchange) {
+			reply(ws, common.OK())
+			return
+		}
+		switch op.Exchange {
+		case "request":
+			request(ws, client)
+		case "upload":
+			UploadServer(ws)
+		case "ingest":
+			IngestServer(ws)
+		case "repair":
+			RepairServer(ws)
+		case "notify":
+			notify(ws, client)
+		case "status":
+			StatusServer(ws)
+		case "query":
+			QueryServer(ws)
+		default:
+			reply(ws, common.Errorf(common.CodeUnsupported, "", "no %q exchange", op.Exchange))
+			log.Printf("Bad message: unknown exchange %q.", op.Exchange)
+			reply(ws, common.OK())
+			return
+		}
+	}
+}
+
+// needs holds the feature a client must have agreed to run each exchange that has one.
+var needs = map[string]string{
+	"upload": common.FeatureUpload,
+	"ingest": common.FeatureIngest,
+	"repair": common.FeatureRepair,
+	"status": common.FeatureStatus,
+	"query":  common.FeatureQuery,
+}
+
+// permitted reports whether client may run the named exchange, sending it an error if
+// it has not agreed the feature the exchange needs.
+func permitted(ws *websocket.Conn, client common.Hello, exchange string) bool {
+	if f, ok := needs[exchange]; ok && !client.Has(f) {
+		reply(ws, common.Errorf(common.CodeUnsupported, "", "the %s exchange needs the %q feature", exchange, f))
+		log.Printf("Rejected %s exchange from %s: %q feature not agreed.", exchange, peer(ws.Request()), f)
+		return false
+	}
+	return true
+}
+
+// negotiated returns the handler of the endpoint of the named exchange, which runs f once
+// the client has completed the handshake and is permitted the exchange.
+func negotiated(exchange string, f func(ws *websocket.Conn)) websocket.Handler {
+	return func(ws *websocket.Conn) {
+		if client, ok := handshake(ws); ok && permitted(ws, client, exchange) {
+			f(ws)
+			return
+		}
+		reply(ws, common.OK())
+	}
+}
@@ -0,0 +1,478 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is the number of bytes written between checkpoints of a partial file.
+const checkpointInterval = 64 << 20
+
+// maxExpansion is the most times larger than the bytes received that the decoded contents
+// of an upload of undeclared size may be, so that a small compressed body cannot fill the
+// store.
+const maxExpansion = 1 << 10
+
+var (
+	partialLock sync.Mutex
+	partials    = make(map[string]bool) // partial files being written
+
+	errBusy      = errors.New("another upload of the file is in progress")
+	errExpansion = errors.New(fmt.Sprintf("contents expand more than %d times when decoded", maxExpansion))
+)
+
+// expansionReader reads decoded contents from r, failing once they are more than
+// maxExpansion times the encoded bytes received, given by n, and an upload block.
+type expansionReader struct {
+	r    io.Reader
+	n    func() int64
+	read int64
+}
+
+func (e *expansionReader) Read(p []byte) (n int, err error) {
+	n, err = e.r.Read(p)
+	if e.read += int64(n); e.read > e.n()*maxExpansion+common.UploadBlock {
+		return n, errExpansion
+	}
+	return
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+// expirePartials removes the partial files of abandoned uploads that have not been
+// written for longer than age.
+func expirePartials(age time.Duration) {
+	interval := age / 10
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	for {
+		names, _ := filepath.Glob(work(".partial-*"))
+		partialLock.Lock()
+		for _, n := range names {
+			if partials[strings.TrimPrefix(filepath.Base(n), ".partial-")] {
+				continue
+			}
+			if fi, err := os.Stat(n); err == nil && time.Since(fi.ModTime()) > age {
+				if err = os.Remove(n); err == nil {
+					log.Printf("Removed abandoned partial file %q.", n)
+				}
+			}
+		}
+		partialLock.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// openPartial opens the partial file for an upload with the digest d, hashing the bytes
+// it already holds with h. Only one upload of a digest may be in progress at a time.
+func openPartial(d string, size int64, h hash.Hash) (f *os.File, err error) {
+	sn, err := common.StoreName(d)
+	if err != nil {
+		return
+	}
+	partialLock.Lock()
+	defer partialLock.Unlock()
+	if partials[sn] {
+		return nil, errBusy
+	}
+	if f, err = os.OpenFile(work(".partial-"+sn), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() > size {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = io.Copy(h, f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	partials[sn] = true
+	return
+}
+
+func closePartial(f *os.File, d string) {
+	f.Close()
+	sn, _ := common.StoreName(d)
+	partialLock.Lock()
+	delete(partials, sn)
+	partialLock.Unlock()
+}
+
+// blockReader reads the contents sent in an /upload exchange as binary messages, up to
+// the empty message that ends them.
+type blockReader struct {
+	ws    *websocket.Conn
+	b     []byte
+	n     int64 // bytes received
+	done  bool
+	fault bool // the connection failed
+}
+
+func (r *blockReader) Read(p []byte) (n int, err error) {
+	for len(r.b) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err = websocket.Message.Receive(r.ws, &r.b); err != nil {
+			r.fault = true
+			return 0, err
+		}
+		if len(r.b) == 0 {
+			r.done = true
+		} else if len(r.b) > common.UploadBlock {
+			return 0, errors.New(fmt.Sprintf("block of %d bytes exceeds %d", len(r.b), common.UploadBlock))
+		}
+		r.n += int64(len(r.b))
+	}
+	n = copy(p, r.b)
+	r.b = r.b[n:]
+	return
+}
+
+// checkpointWriter writes to a file, syncing it periodically if sync is true so that
+// the bytes held are durable when an upload is resumed.
+type checkpointWriter struct {
+	f    *os.File
+	sync bool
+	n    int64
+}
+
+func (w *checkpointWriter) Write(b []byte) (n int, err error) {
+	n, err = w.f.Write(b)
+	if w.n += int64(n); w.sync && w.n >= checkpointInterval {
+		w.f.Sync()
+		w.n = 0
+	}
+	return
+}
+
+// UploadServer receives a file over the connection, hashing it as it is written to a
+// temporary file in the work directory. The file is renamed to its store name once the
+// digest sent by the client has been checked against the complete file, and quarantined
+// if it does not match. Partial files of resumable uploads are kept when the connection
+// is lost.
+func UploadServer(ws *websocket.Conn) {
+	var (
+		m    string
+		up   common.Upload
+		h    hash.Hash
+		f    *os.File
+		w    io.Writer
+		br   *blockReader
+		src  io.Reader
+		keep bool
+		size int64
+		d    string
+		sn   string
+		err  error
+
+		release = func() {}
+	)
+	defer func() { release() }()
+
+	if err = websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err = json.Unmarshal([]byte(m), &up); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+	if _, ok := common.Negotiate([]string{up.Hash}, hashes); !ok {
+		reply(ws, common.Errorf(common.CodeUnsupported, up.Name, "%q hash algorithm %q not accepted", up.Name, up.Hash))
+		goto bye
+	}
+	if _, ok := common.Negotiate([]string{up.Encoding}, encodings); up.Encoding != "" && !ok {
+		reply(ws, common.Errorf(common.CodeUnsupported, up.Name, "%q encoding %q not accepted", up.Name, up.Encoding))
+		goto bye
+	}
+	h, _ = common.NewHash(up.Hash)
+	if up.Digest != "" {
+		if alg, _, err := common.ParseDigest(up.Digest); err != nil {
+			reply(ws, common.Errorf(common.CodeBadMessage, up.Name, "%v", err))
+			goto bye
+		} else if alg != up.Hash {
+			reply(ws, common.Errorf(common.CodeBadMessage, up.Name, "%q digest is not a %s digest", up.Name, up.Hash))
+			goto bye
+		}
+		if f, err = openPartial(up.Digest, up.Size, h); err != nil {
+			code := common.CodeServerFault
+			if err == errBusy {
+				code = common.CodeBusy
+			}
+			reply(ws, common.Errorf(code, up.Name, "cannot upload %q: %v.", up.Name, err))
+			log.Printf("Server fault: %v", err)
+			goto bye
+		}
+		keep = true
+	} else if f, err = ioutil.TempFile(filepath.Join(targetdir, workDir), ".incoming-"); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, up.Name, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	// The partial file is released before the client is thanked so that
+	// a failed upload can be retried at once.
+	release = func() {
+		release = func() {}
+		if keep {
+			f.Sync()
+		} else if sn == "" {
+			os.Remove(f.Name())
+		}
+		if up.Digest != "" {
+			closePartial(f, up.Digest)
+		} else {
+			f.Close()
+		}
+	}
+	if up.Offset, err = f.Seek(0, 2); err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, up.Name, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	if up.Offset > 0 {
+		log.Printf("Resuming %q at byte %d.", up.Name, up.Offset)
+	}
+	if err = replyData(ws, common.KindData, up); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+
+	w = io.MultiWriter(&checkpointWriter{f: f, sync: keep}, h)
+	br = &blockReader{ws: ws}
+	src = br
+	if up.Encoding != "" {
+		var dec io.ReadCloser
+		if dec, err = common.NewDecoder(up.Encoding, br); err == nil {
+			defer dec.Close()
+			src = dec
+		}
+	}
+	if err == nil {
+		// Guard against contents that decode to more than was declared.
+		if up.Size > 0 {
+			src = io.LimitReader(src, up.Size-up.Offset+1)
+		} else if up.Encoding != "" {
+			src = &expansionReader{r: src, n: func() int64 { return br.n }}
+		}
+		size, err = io.Copy(w, src)
+		size += up.Offset
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, br)
+	}
+	if err == errExpansion {
+		keep = false
+		reply(ws, common.Errorf(common.CodeTooLarge, up.Name, "cannot store %q: %v.", up.Name, err))
+		goto bye
+	} else if err != nil {
+		if br.fault {
+			log.Printf("Websocket fault: %v", err)
+			return
+		}
+		reply(ws, common.Errorf(common.CodeTransfer, up.Name, "cannot store %q: %v.", up.Name, err))
+		log.Printf("Upload of %q failed: %v", up.Name, err)
+		goto bye
+	}
+	if up.Size > 0 && size > up.Size {
+		keep = false
+		reply(ws, common.Errorf(common.CodeTooLarge, up.Name, "%q is larger than the declared %d bytes.", up.Name, up.Size))
+		goto bye
+	}
+	if err = websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if d = common.Digest(up.Hash, h.Sum(nil)); !common.EqualDigests(d, m) || (up.Digest != "" && !common.EqualDigests(d, up.Digest)) {
+		keep = false // A damaged partial file cannot be resumed.
+		q := Quarantine{Name: up.Name, Source: peer(ws.Request()), Expected: m, Got: d, Size: size}
+		if up.Digest != "" {
+			q.Expected = up.Digest
+		}
+		if err = quarantine(f.Name(), q); err != nil {
+			log.Printf("Server fault: %v", err)
+		}
+		reply(ws, common.Errorf(common.CodeMismatch, up.Name, "%q did not verify correctly and must be resent: %s != %s.", up.Name, d, q.Expected))
+		goto bye
+	}
+
+	keep = false
+	if err = f.Sync(); err == nil {
+		err = commit(f.Name(), d)
+	}
+	if err != nil {
+		reply(ws, common.Errorf(common.CodeServerFault, up.Name, "Server fault: %v.", err))
+		log.Printf("Server fault: %v", err)
+		goto bye
+	}
+	sn, _ = common.StoreName(d)
+	if up.Encoding != "" {
+		log.Printf("Received %q as %q (%d bytes, %d %s encoded).", up.Name, sn, size, br.n, up.Encoding)
+	} else {
+		log.Printf("Received %q as %q (%d bytes).", up.Name, sn, size)
+	}
+	replyData(ws, common.KindData, d)
+
+bye:
+	release()
+	reply(ws, common.OK())
+}
+
+// httpError replies to an HTTP request with the given status and the error message m.
+func httpError(w http.ResponseWriter, status int, m common.Message) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(m)
+}
+
+// StoreServer receives a file by HTTP PUT to /store/<store name>. The contents are
+// hashed as they are written to a temporary file in the work directory, which is
+// renamed to the store name only if they match the digest it names and is quarantined
+// otherwise.
+func StoreServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		httpError(w, http.StatusMethodNotAllowed, common.Errorf(common.CodeBadMessage, "", "PUT required"))
+		return
+	}
+	sn := r.URL.Path[len("/store/"):]
+	var hello common.Hello
+	json.Unmarshal([]byte(r.Header.Get(common.HelloHeader)), &hello)
+	client, err := common.Agree(hello)
+	if err != nil {
+		log.Printf("Rejected client %s: %v", peer(r), err)
+		httpError(w, http.StatusBadRequest, common.Errorf(common.CodeIncompatible, sn, "%v", err))
+		return
+	}
+	enc := r.Header.Get("Content-Encoding")
+	if enc != "" && !client.Has(common.FeatureCompress) {
+		httpError(w, http.StatusBadRequest, common.Errorf(common.CodeUnsupported, sn, "encoding %q needs the %q feature", enc, common.FeatureCompress))
+		return
+	}
+	if _, ok := common.Negotiate([]string{enc}, encodings); enc != "" && !ok {
+		httpError(w, http.StatusUnsupportedMediaType, common.Errorf(common.CodeUnsupported, sn, "encoding %q not accepted", enc))
+		return
+	}
+	d, err := common.ParseStoreName(sn)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, common.Errorf(common.CodeBadMessage, sn, "%v", err))
+		return
+	}
+	alg, _, _ := common.ParseDigest(d)
+	if _, ok := common.Negotiate([]string{alg}, hashes); !ok {
+		httpError(w, http.StatusBadRequest, common.Errorf(common.CodeUnsupported, sn, "hash algorithm %q not accepted", alg))
+		return
+	}
+	h, _ := common.NewHash(alg)
+
+	f, err := ioutil.TempFile(filepath.Join(targetdir, workDir), ".incoming-")
+	if err != nil {
+		log.Printf("Server fault: %v", err)
+		httpError(w, http.StatusInternalServerError, common.Errorf(common.CodeServerFault, sn, "server fault"))
+		return
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name()) // Fails harmlessly once renamed.
+	}()
+	var (
+		body     io.Reader = r.Body
+		declared int64     = -1
+	)
+	if enc != "" {
+		if s := r.Header.Get(common.SizeHeader); s != "" {
+			if declared, err = strconv.ParseInt(s, 10, 64); err != nil || declared < 0 {
+				httpError(w, http.StatusBadRequest, common.Errorf(common.CodeBadMessage, sn, "bad %s header %q", common.SizeHeader, s))
+				return
+			}
+		}
+		cr := &countReader{r: r.Body}
+		dec, err := common.NewDecoder(enc, cr)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, common.Errorf(common.CodeTransfer, sn, "%v", err))
+			return
+		}
+		defer dec.Close()
+		// Guard against contents that decode to more than was declared.
+		if declared >= 0 {
+			body = io.LimitReader(dec, declared+1)
+		} else {
+			body = &expansionReader{r: dec, n: func() int64 { return cr.n }}
+		}
+	}
+	size, err := io.Copy(io.MultiWriter(f, h), body)
+	if err == nil && declared >= 0 && size > declared {
+		err = errors.New(fmt.Sprintf("contents are larger than the declared %d bytes", declared))
+	}
+	if err == errExpansion || (declared >= 0 && size > declared) {
+		httpError(w, http.StatusRequestEntityTooLarge, common.Errorf(common.CodeTooLarge, sn, "%v", err))
+		return
+	} else if err != nil {
+		log.Printf("Upload of %q failed: %v", sn, err)
+		httpError(w, http.StatusBadRequest, common.Errorf(common.CodeTransfer, sn, "%v", err))
+		return
+	}
+	if got := common.Digest(alg, h.Sum(nil)); !common.EqualDigests(got, d) {
+		if err = quarantine(f.Name(), Quarantine{Name: sn, Source: peer(r), Expected: d, Got: got, Size: size}); err != nil {
+			log.Printf("Server fault: %v", err)
+		}
+		httpError(w, http.StatusConflict, common.Errorf(common.CodeMismatch, sn, "did not verify correctly and must be resent: %s != %s", got, d))
+		return
+	}
+	if err = f.Sync(); err == nil {
+		err = commit(f.Name(), d)
+	}
+	if err != nil {
+		log.Printf("Server fault: %v", err)
+		httpError(w, http.StatusInternalServerError, common.Errorf(common.CodeServerFault, sn, "server fault"))
+		return
+	}
+	log.Printf("Received %q (%d bytes).", sn, size)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestExpansionReader(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		decoded int64
+		limit   bool
+	}{
+		{name: "small", decoded: 1 << 10},
+		{name: "block", decoded: common.UploadBlock},
+		{name: "bomb", decoded: 64 * common.UploadBlock, limit: true},
+	} {
+		var enc bytes.Buffer
+		w, err := common.NewEncoder("zstd", &enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.Copy(w, io.LimitReader(zeros{}, test.decoded)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		br := &countReader{r: &enc}
+		dec, err := common.NewDecoder("zstd", br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, &expansionReader{r: dec, n: func() int64 { return br.n }})
+		if test.limit {
+			if err != errExpansion {
+				t.Errorf("%s: got error %v after %d bytes, want %v", test.name, err, n, errExpansion)
+			}
+			if max := br.n*maxExpansion + common.UploadBlock + 64<<10; n > max {
+				t.Errorf("%s: read %d bytes, more than %d", test.name, n, max)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if n != test.decoded {
+			t.Errorf("%s: read %d bytes, want %d", test.name, n, test.decoded)
+		}
+	}
+}
+
+// zeros is an endless source of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,360 @@
+/*
+Copyright ©2011 Dan Kortschak <dan.kortschak@adelaide.edu.au>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http:www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/gdacap.transmeta/common"
+	"code.google.com/p/go.net/websocket"
+
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// verifier checks stored outputs against their notified digests in the background.
+// Its queue is unbounded so that notifications are never held up by verification.
+//
+// Final states are appended to a state file so that they are reported after a restart,
+// and are forgotten once they are older than the verifier's age, both in memory and when
+// the state file is rewritten, so that neither grows without bound.
+type verifier struct {
+	mu     sync.Mutex
+	queue  []common.Output // files waiting for a worker
+	ready  *sync.Cond      // signalled when the queue grows
+	status map[string]state
+	subs   map[string][]chan common.Status
+
+	path string
+	f    *os.File // state file, nil if final states are not kept
+	age  time.Duration
+}
+
+// state is the Status of a file and the time it was set.
+type state struct {
+	common.Status
+	Time time.Time
+}
+
+// newVerifier starts workers verifiers, keeping final states in the file at path for age.
+// If path is empty final states are not kept across restarts; if age is zero they are
+// never forgotten.
+func newVerifier(workers int, path string, age time.Duration) (v *verifier, err error) {
+	if workers < 1 {
+		workers = 1
+	}
+	v = &verifier{
+		status: make(map[string]state),
+		subs:   make(map[string][]chan common.Status),
+		path:   path,
+		age:    age,
+	}
+	v.ready = sync.NewCond(&v.mu)
+	if path != "" {
+		if err = v.load(); err != nil {
+			return nil, err
+		}
+		if err = v.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go v.work()
+	}
+	if age > 0 {
+		go v.expire()
+	}
+	return
+}
+
+// load reads the final states held in the state file, keeping the last state of each
+// file that has not expired. A line cut short by a crash is ignored.
+func (v *verifier) load() (err error) {
+	f, err := os.Open(v.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		var st state
+		if json.Unmarshal(b, &st) != nil || st.Hash == "" || !st.Final() {
+			continue
+		}
+		if v.expired(st) {
+			delete(v.status, st.Hash)
+			continue
+		}
+		v.status[st.Hash] = st
+	}
+}
+
+// rewrite replaces the state file with the final states held in memory and opens it to
+// append further states. It is called with v.mu held, or before the verifier starts.
+func (v *verifier) rewrite() (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(v.path), ".states-")
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, st := range v.status {
+		if st.Final() {
+			if err = enc.Encode(st); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), v.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	f, err := os.OpenFile(v.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	if v.f != nil {
+		v.f.Close()
+	}
+	v.f = f
+	return
+}
+
+func (v *verifier) expired(st state) bool {
+	return v.age > 0 && st.Final() && time.Since(st.Time) > v.age
+}
+
+// expire forgets expired final states, rewriting the state file if any were forgotten.
+func (v *verifier) expire() {
+	interval := v.age / 10
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	for {
+		time.Sleep(interval)
+		v.mu.Lock()
+		var n int
+		for h, st := range v.status {
+			if v.expired(st) {
+				delete(v.status, h)
+				n++
+			}
+		}
+		if n > 0 && v.f != nil {
+			if err := v.rewrite(); err != nil {
+				log.Printf("Could not rewrite verification states: %v", err)
+			}
+		}
+		v.mu.Unlock()
+	}
+}
+
+func (v *verifier) work() {
+	for {
+		v.mu.Lock()
+		for len(v.queue) == 0 {
+			v.ready.Wait()
+		}
+		file := v.queue[0]
+		v.queue[0] = common.Output{}
+		v.queue = v.queue[1:]
+		v.mu.Unlock()
+
+		ok, msgs := verifyOutput(file)
+		s := common.Status{Hash: file.Hash, Name: file.OriginalName, State: common.StatusVerified, Messages: msgs}
+		if !ok {
+			s.State = common.StatusFailed
+		}
+		log.Printf("Verification of %q (%s): %s.", file.OriginalName, file.Hash, s.State)
+		v.set(s)
+	}
+}
+
+// enqueue schedules file for verification, returning its pending Status. A file that is
+// already pending is not queued again. enqueue does not block.
+func (v *verifier) enqueue(file common.Output) common.Status {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if cur, ok := v.status[file.Hash]; ok && cur.State == common.StatusPending {
+		return cur.Status
+	}
+	s := common.Status{Hash: file.Hash, Name: file.OriginalName, State: common.StatusPending}
+	v.status[file.Hash] = state{Status: s, Time: time.Now()}
+	v.queue = append(v.queue, file)
+	v.ready.Signal()
+	return s
+}
+
+// set records s, appending it to the state file if it is final. The state file is not
+// synced; a state lost in a crash is reported as unknown and can be verified again.
+func (v *verifier) set(s common.Status) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	st := state{Status: s, Time: time.Now()}
+	v.status[s.Hash] = st
+	if s.Final() && v.f != nil {
+		b, err := json.Marshal(st)
+		if err == nil {
+			_, err = v.f.Write(append(b, '\n'))
+		}
+		if err != nil {
+			log.Printf("Could not record verification state of %q: %v", s.Name, err)
+		}
+	}
+	for _, c := range v.subs[s.Hash] {
+		select {
+		case c <- s:
+		default:
+		}
+	}
+	if s.Final() {
+		delete(v.subs, s.Hash)
+	}
+}
+
+// lookup returns the current Status of each of hashes. If c is not nil it is subscribed
+// to later changes of any that are not final.
+func (v *verifier) lookup(hashes []string, c chan common.Status) (states []common.Status) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, h := range hashes {
+		s := common.Status{Hash: h, State: common.StatusUnknown}
+		if st, ok := v.status[h]; ok && !v.expired(st) {
+			s = st.Status
+		}
+		states = append(states, s)
+		if c != nil && !s.Final() {
+			v.subs[h] = append(v.subs[h], c)
+		}
+	}
+	return
+}
+
+func (v *verifier) unsubscribe(c chan common.Status) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for h, cs := range v.subs {
+		for i := range cs {
+			if cs[i] == c {
+				v.subs[h] = append(cs[:i], cs[i+1:]...)
+				break
+			}
+		}
+		if len(v.subs[h]) == 0 {
+			delete(v.subs, h)
+		}
+	}
+}
+
+// statusPing is the interval between pings of a client waiting for verification.
+const statusPing = 30 * time.Second
+
+// ping sends a websocket ping to the client, failing if the connection has closed.
+func ping(ws *websocket.Conn) (err error) {
+	pt := ws.PayloadType
+	ws.PayloadType = websocket.PingFrame
+	_, err = ws.Write(nil)
+	ws.PayloadType = pt
+	return
+}
+
+// StatusServer reports the verification state of stored outputs. The client sends a
+// StatusQuery and receives a JSON list of Status, followed by each change of state as a
+// JSON Status when waiting is requested.
+func StatusServer(ws *websocket.Conn) {
+	var (
+		m       string
+		q       common.StatusQuery
+		c       chan common.Status
+		states  []common.Status
+		pending int
+	)
+
+	if err := websocket.Message.Receive(ws, &m); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if err := json.Unmarshal([]byte(m), &q); err != nil {
+		reply(ws, common.Errorf(common.CodeBadMessage, "", "could not parse"))
+		log.Printf("Bad message: malformed JSON %q: %v.", m, err)
+		goto bye
+	}
+
+	if q.Wait {
+		c = make(chan common.Status, len(q.Hashes))
+		defer verify.unsubscribe(c)
+	}
+	states = verify.lookup(q.Hashes, c)
+	for _, s := range states {
+		if !s.Final() {
+			pending++
+		}
+	}
+	if err := replyData(ws, common.KindStatus, states); err != nil {
+		log.Printf("Websocket fault: %v", err)
+		return
+	}
+	if q.Wait && pending > 0 {
+		// The client is pinged while it waits so that the wait ends if it has gone.
+		tick := time.NewTicker(statusPing)
+		defer tick.Stop()
+		for pending > 0 {
+			select {
+			case s := <-c:
+				if err := replyData(ws, common.KindStatus, []common.Status{s}); err != nil {
+					log.Printf("Websocket fault: %v", err)
+					return
+				}
+				pending--
+			case <-tick.C:
+				if err := ping(ws); err != nil {
+					log.Printf("Websocket fault: %v", err)
+					return
+				}
+			}
+		}
+	}
+
+bye:
+	reply(ws, common.OK())
+}